@@ -1,11 +1,15 @@
 package aggro
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
 	. "github.com/onsi/gomega"
+	"github.com/shopspring/decimal"
 )
 
 var (
@@ -30,6 +34,33 @@ var (
 	}
 )
 
+// departmentResults runs a query for the metrics against the test rows,
+// bucketed by location then department, and then by the nested bucket if given.
+func departmentResults(t *testing.T, metrics []Metric, nested *Bucket) (*Query, *Resultset) {
+	query := &Query{
+		Metrics: metrics,
+		Bucket: &Bucket{
+			Field: &Field{Name: "location", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field:  &Field{Name: "department", Type: "string"},
+				Sort:   &SortOptions{Type: "alphabetical"},
+				Bucket: nested,
+			},
+		},
+	}
+	dataset := &Dataset{Table: table}
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	return query, results
+}
+
 func TestBucketByString(t *testing.T) {
 	RegisterTestingT(t)
 	dataset := &Dataset{
@@ -693,3 +724,2050 @@ func TestBucketByRange(t *testing.T) {
 	em, _ := json.Marshal(expected)
 	Expect(rm).To(MatchJSON(em))
 }
+
+func TestSiblingAggregations(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Aggregations: map[string]*Query{
+			"locations": {
+				Metrics: []Metric{
+					{Type: "count", Field: "salary"},
+				},
+				Bucket: &Bucket{
+					Field: &Field{
+						Name: "location",
+						Type: "string",
+					},
+					Sort: &SortOptions{
+						Type: "alphabetical",
+					},
+					Aggregations: map[string]*Query{
+						"departments": {
+							Metrics: []Metric{
+								{Type: "max", Field: "salary"},
+							},
+							Bucket: &Bucket{
+								Field: &Field{
+									Name: "department",
+									Type: "string",
+								},
+								Sort: &SortOptions{
+									Type: "alphabetical",
+								},
+							},
+						},
+					},
+				},
+			},
+			"departments": {
+				Metrics: []Metric{
+					{Type: "sum", Field: "salary"},
+				},
+				Bucket: &Bucket{
+					Field: &Field{
+						Name: "department",
+						Type: "string",
+					},
+					Sort: &SortOptions{
+						Type: "alphabetical",
+					},
+				},
+			},
+		},
+	}
+
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	expected := Resultset{
+		Aggregations: map[string]*Resultset{
+			"locations": {
+				Buckets: []*ResultBucket{
+					{
+						Value: "Auckland",
+						Metrics: map[string]interface{}{
+							"salary:count": 4,
+						},
+						Aggregations: map[string]*Resultset{
+							"departments": {
+								Buckets: []*ResultBucket{
+									{
+										Value: "Engineering",
+										Metrics: map[string]interface{}{
+											"salary:max": 120000,
+										},
+									},
+									{
+										Value: "Marketing",
+										Metrics: map[string]interface{}{
+											"salary:max": 150000,
+										},
+									},
+								},
+							},
+						},
+					},
+					{
+						Value: "Wellington",
+						Metrics: map[string]interface{}{
+							"salary:count": 3,
+						},
+						Aggregations: map[string]*Resultset{
+							"departments": {
+								Buckets: []*ResultBucket{
+									{
+										Value: "Engineering",
+										Metrics: map[string]interface{}{
+											"salary:max": 160000,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			"departments": {
+				Buckets: []*ResultBucket{
+					{
+						Value: "Engineering",
+						Metrics: map[string]interface{}{
+							"salary:sum": 600000,
+						},
+					},
+					{
+						Value: "Marketing",
+						Metrics: map[string]interface{}{
+							"salary:sum": 240000,
+						},
+					},
+				},
+			},
+		},
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(expected)
+	Expect(rm).To(MatchJSON(em))
+}
+
+func TestBucketByFilters(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "count", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{
+				Name: "location",
+				Type: "string",
+			},
+			Sort: &SortOptions{
+				Type: "alphabetical",
+			},
+			Bucket: &Bucket{
+				FilterOptions: &FilterBucketOptions{
+					Value: "engineering",
+					Filter: &Filter{
+						Field:    "department",
+						Operator: "eq",
+						Value:    "Engineering",
+					},
+				},
+				Bucket: &Bucket{
+					FiltersOptions: &FiltersBucketOptions{
+						Filters: map[string]*Filter{
+							"senior": {Field: "salary", Operator: "gt", Value: 130000},
+							"junior": {Field: "salary", Operator: "lt", Value: 90000},
+							"early": {
+								All: []*Filter{
+									{Field: "start_date", Operator: "lt", Value: "2016-02-01T00:00:00Z"},
+									{Field: "salary", Operator: "gte", Value: 100000},
+								},
+							},
+						},
+					},
+					Sort: &SortOptions{
+						Type: "alphabetical",
+					},
+				},
+			},
+		},
+	}
+
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	expected := Resultset{
+		Buckets: []*ResultBucket{
+			{
+				Value: "Auckland",
+				Buckets: []*ResultBucket{
+					{
+						Value: "engineering",
+						Buckets: []*ResultBucket{
+							{
+								Value: "early",
+								Metrics: map[string]interface{}{
+									"salary:count": 1,
+								},
+							},
+							{
+								Value: "junior",
+								Metrics: map[string]interface{}{
+									"salary:count": 1,
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				Value: "Wellington",
+				Buckets: []*ResultBucket{
+					{
+						Value: "engineering",
+						Buckets: []*ResultBucket{
+							{
+								Value: "early",
+								Metrics: map[string]interface{}{
+									"salary:count": 1,
+								},
+							},
+							{
+								Value: "senior",
+								Metrics: map[string]interface{}{
+									"salary:count": 1,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(expected)
+	Expect(rm).To(MatchJSON(em))
+
+	// A bucket can't both narrow its rows and split them by filters.
+	_, err = dataset.Run(&Query{
+		Bucket: &Bucket{
+			FilterOptions: &FilterBucketOptions{
+				Value:  "engineering",
+				Filter: &Filter{Field: "department", Operator: "eq", Value: "Engineering"},
+			},
+			FiltersOptions: &FiltersBucketOptions{
+				Filters: map[string]*Filter{
+					"senior": {Field: "salary", Operator: "gt", Value: 130000},
+				},
+			},
+		},
+	})
+	Expect(err).To(MatchError("Query bucket at depth 0 has both FilterOptions and FiltersOptions set"))
+
+	// Filter values are converted to the field's type before any rows are
+	// matched.
+	_, err = dataset.Run(&Query{
+		Bucket: &Bucket{
+			FilterOptions: &FilterBucketOptions{
+				Value:  "senior",
+				Filter: &Filter{Field: "salary", Operator: "gt", Value: "lots"},
+			},
+		},
+	})
+	Expect(err).To(MatchError(ContainSubstring("Invalid filter value for field salary")))
+
+	// Unknown fields and operators are rejected, even on datasets without rows.
+	empty := &Dataset{Table: table}
+	_, err = empty.Run(&Query{
+		Bucket: &Bucket{
+			FilterOptions: &FilterBucketOptions{
+				Value:  "engineering",
+				Filter: &Filter{Field: "departmnt", Operator: "eq", Value: "Engineering"},
+			},
+		},
+	})
+	Expect(err).To(MatchError("Unknown filter field: departmnt"))
+	_, err = empty.Run(&Query{
+		Bucket: &Bucket{
+			FiltersOptions: &FiltersBucketOptions{
+				Filters: map[string]*Filter{
+					"other": {Any: []*Filter{{Field: "department", Operator: "neq", Value: "Engineering"}}},
+				},
+			},
+		},
+	})
+	Expect(err).To(MatchError("Unknown filter operator: neq"))
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "sum", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{
+				Name: "start_date",
+				Type: "datetime",
+			},
+			DatetimeOptions: &DatetimeBucketOptions{
+				Period:   Month,
+				Location: time.UTC,
+			},
+			Sort: &SortOptions{
+				Type: "alphabetical",
+			},
+			Pipelines: []PipelineMetric{
+				{Type: "derivative", Metric: "salary:sum"},
+				{Type: "cumulative_sum", Metric: "salary:sum"},
+				{Type: "moving_average", Metric: "salary:sum", Window: 2},
+				{Type: "moving_average", Metric: "salary:sum", Window: 2, Model: "ewma", Alpha: 0.25, Name: "ewma"},
+				{Type: "percent_of_total", Metric: "salary:sum"},
+			},
+		},
+	}
+
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	expected := Resultset{
+		Buckets: []*ResultBucket{
+			{
+				Value: "2016-01-01T00:00:00Z",
+				Metrics: map[string]interface{}{
+					"salary:sum":                  480000,
+					"salary:sum:derivative":       nil,
+					"salary:sum:cumulative_sum":   480000,
+					"salary:sum:moving_average":   480000,
+					"ewma":                        480000,
+					"salary:sum:percent_of_total": 57.14285714285714,
+				},
+			},
+			{
+				Value: "2016-02-01T00:00:00Z",
+				Metrics: map[string]interface{}{
+					"salary:sum":                  120000,
+					"salary:sum:derivative":       -360000,
+					"salary:sum:cumulative_sum":   600000,
+					"salary:sum:moving_average":   300000,
+					"ewma":                        390000,
+					"salary:sum:percent_of_total": 14.285714285714285,
+				},
+			},
+			{
+				Value: "2016-03-01T00:00:00Z",
+				Metrics: map[string]interface{}{
+					"salary:sum":                  240000,
+					"salary:sum:derivative":       120000,
+					"salary:sum:cumulative_sum":   840000,
+					"salary:sum:moving_average":   180000,
+					"ewma":                        150000,
+					"salary:sum:percent_of_total": 28.57142857142857,
+				},
+			},
+		},
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(expected)
+	Expect(rm).To(MatchJSON(em))
+
+	// Without a sort, pipelines run over the buckets in key order.
+	query.Bucket.Sort = nil
+	for i := 0; i < 5; i++ {
+		results, err = dataset.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running query: %s", err.Error())
+		}
+		rm, _ = json.Marshal(*results)
+		Expect(rm).To(MatchJSON(em))
+	}
+
+	// Unknown pipelines fail before anything is measured.
+	empty := &Dataset{Table: table}
+	query.Bucket.Pipelines = []PipelineMetric{{Type: "cumulative-sum", Metric: "salary:sum"}}
+	_, err = empty.Run(query)
+	Expect(err).To(MatchError("Unknown pipeline metric: cumulative-sum"))
+	query.Bucket.Pipelines = []PipelineMetric{{Type: "moving_average", Model: "holt", Metric: "salary:sum"}}
+	_, err = empty.Run(query)
+	Expect(err).To(MatchError("Unknown moving average model: holt"))
+
+	// Pipelines can only read metrics measured at their level.
+	query.Bucket.Pipelines = []PipelineMetric{
+		{Type: "derivative", Metric: "salary:mean"},
+	}
+	_, err = dataset.Run(query)
+	Expect(err).To(MatchError("Query pipeline at depth 0 reads metric salary:mean, which isn't measured at that level"))
+
+	query.Bucket.Pipelines = nil
+	query.Bucket.Bucket = &Bucket{
+		Field:     &Field{Name: "location", Type: "string"},
+		Pipelines: []PipelineMetric{{Type: "cumulative_sum", Metric: "salary:sum"}},
+	}
+	query.Bucket.Pipelines = []PipelineMetric{
+		{Type: "cumulative_sum", Metric: "salary:sum"},
+	}
+	_, err = dataset.Run(query)
+	Expect(err).To(MatchError("Query pipeline at depth 0 reads metric salary:sum, which isn't measured at that level"))
+}
+
+func TestBucketSelectors(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "mean", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{
+				Name: "location",
+				Type: "string",
+			},
+			Sort: &SortOptions{
+				Type: "alphabetical",
+			},
+			Bucket: &Bucket{
+				Field: &Field{
+					Name: "department",
+					Type: "string",
+				},
+				Sort: &SortOptions{
+					Type: "alphabetical",
+				},
+				Selectors: []BucketSelector{
+					{Metric: "count", Operator: "gte", Value: 2},
+					{Metric: "salary:mean", Operator: "gt", Value: 110000},
+				},
+			},
+		},
+	}
+
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	expected := Resultset{
+		Buckets: []*ResultBucket{
+			{
+				Value: "Auckland",
+				Buckets: []*ResultBucket{
+					{
+						Value: "Marketing",
+						Metrics: map[string]interface{}{
+							"salary:mean": 120000,
+						},
+					},
+				},
+			},
+			{
+				Value: "Wellington",
+				Buckets: []*ResultBucket{
+					{
+						Value: "Engineering",
+						Metrics: map[string]interface{}{
+							"salary:mean": 133333.33333333334,
+						},
+					},
+				},
+			},
+		},
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(expected)
+	Expect(rm).To(MatchJSON(em))
+
+	// Parents are removed once all of their children have been.
+	query.Bucket.Bucket.Selectors = []BucketSelector{
+		{Metric: "salary:mean", Operator: "gt", Value: 125000},
+	}
+	results, err = dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	Expect(results.Buckets).To(HaveLen(1))
+	Expect(results.Buckets[0].Value).To(Equal("Wellington"))
+
+	// Selectors on a parent bucket can use the row count.
+	query.Bucket.Selectors = []BucketSelector{
+		{Metric: "count", Operator: "lt", Value: 3},
+	}
+	results, err = dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	Expect(results.Buckets).To(BeEmpty())
+
+	// Parent buckets aren't measured, so their selectors can't test metrics.
+	query.Bucket.Selectors = []BucketSelector{
+		{Metric: "salary:mean", Operator: "gt", Value: 100000},
+	}
+	_, err = dataset.Run(query)
+	Expect(err).To(MatchError("Query selector at depth 0 tests metric salary:mean, which isn't measured at that level"))
+
+	// Nor can selectors test metrics that aren't measured at all.
+	query.Bucket.Selectors = nil
+	query.Bucket.Bucket.Selectors = []BucketSelector{
+		{Metric: "salary:meen", Operator: "gt", Value: 100000},
+	}
+	_, err = dataset.Run(query)
+	Expect(err).To(MatchError("Query selector at depth 1 tests metric salary:meen, which isn't measured at that level"))
+
+	// Operators are checked even when no bucket reaches the selector.
+	query.Bucket.Bucket.Selectors = []BucketSelector{
+		{Metric: "count", Operator: "neq", Value: 1},
+	}
+	_, err = (&Dataset{Table: table}).Run(query)
+	Expect(err).To(MatchError("Unknown selector operator: neq"))
+}
+
+func TestBucketScripts(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "sum", Field: "salary"},
+			{Type: "count", Field: "salary"},
+			{Type: "max", Field: "salary"},
+			{Type: "min", Field: "salary"},
+		},
+		Scripts: []BucketScript{
+			{Name: "average", Script: "salary:sum / salary:count"},
+			{Name: "spread", Script: "salary:max - salary:min"},
+			{Name: "band", Script: "if(average > 110000, 'high', 'low')"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{
+				Name: "location",
+				Type: "string",
+			},
+			Sort: &SortOptions{
+				Type: "alphabetical",
+			},
+			Bucket: &Bucket{
+				Field: &Field{
+					Name: "department",
+					Type: "string",
+				},
+				Sort: &SortOptions{
+					Type:   "metric",
+					Metric: "average",
+					Desc:   true,
+				},
+			},
+		},
+	}
+
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	expected := Resultset{
+		Buckets: []*ResultBucket{
+			{
+				Value: "Auckland",
+				Buckets: []*ResultBucket{
+					{
+						Value: "Marketing",
+						Metrics: map[string]interface{}{
+							"salary:sum":   240000,
+							"salary:count": 2,
+							"salary:max":   150000,
+							"salary:min":   90000,
+							"average":      120000,
+							"spread":       60000,
+							"band":         "high",
+						},
+					},
+					{
+						Value: "Engineering",
+						Metrics: map[string]interface{}{
+							"salary:sum":   200000,
+							"salary:count": 2,
+							"salary:max":   120000,
+							"salary:min":   80000,
+							"average":      100000,
+							"spread":       40000,
+							"band":         "low",
+						},
+					},
+				},
+			},
+			{
+				Value: "Wellington",
+				Buckets: []*ResultBucket{
+					{
+						Value: "Engineering",
+						Metrics: map[string]interface{}{
+							"salary:sum":   400000,
+							"salary:count": 3,
+							"salary:max":   160000,
+							"salary:min":   120000,
+							"average":      133333.33333333334,
+							"spread":       40000,
+							"band":         "high",
+						},
+					},
+				},
+			},
+		},
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(expected)
+	Expect(rm).To(MatchJSON(em))
+
+	// Referring to an unknown metric is an error.
+	query.Scripts = []BucketScript{{Name: "bad", Script: "salary:median * 2"}}
+	_, err = dataset.Run(query)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestDerivedFields(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: &Table{
+			Fields: table.Fields,
+			Derived: []DerivedField{
+				{Field{"salary_k", "number"}, "salary / 1000"},
+				{Field{"office", "string"}, "lower(location) + '/' + lower(department)"},
+				{Field{"start_month", "datetime"}, "trunc(start_date, 'month')"},
+				{Field{"band", "string"}, "case(salary_k >= 130, 'senior', salary_k < 90, 'junior', 'mid')"},
+			},
+		},
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "sum", Field: "salary_k"},
+			{Type: "cardinality", Field: "office"},
+		},
+		Bucket: &Bucket{
+			FilterOptions: &FilterBucketOptions{
+				Value: "since february",
+				Filter: &Filter{
+					Field:    "start_month",
+					Operator: "gte",
+					Value:    "2016-02-01T00:00:00Z",
+				},
+			},
+			Bucket: &Bucket{
+				Field: &Field{
+					Name: "band",
+					Type: "string",
+				},
+				Sort: &SortOptions{
+					Type: "alphabetical",
+				},
+			},
+		},
+	}
+
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	expected := Resultset{
+		Buckets: []*ResultBucket{
+			{
+				Value: "since february",
+				Buckets: []*ResultBucket{
+					{
+						Value: "junior",
+						Metrics: map[string]interface{}{
+							"salary_k:sum":       80,
+							"office:cardinality": 1,
+						},
+					},
+					{
+						Value: "mid",
+						Metrics: map[string]interface{}{
+							"salary_k:sum":       120,
+							"office:cardinality": 1,
+						},
+					},
+					{
+						Value: "senior",
+						Metrics: map[string]interface{}{
+							"salary_k:sum":       160,
+							"office:cardinality": 1,
+						},
+					},
+				},
+			},
+		},
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(expected)
+	Expect(rm).To(MatchJSON(em))
+
+	// Derived values must match the field type.
+	dataset.Table.Derived = []DerivedField{
+		{Field{"office", "number"}, "location + department"},
+	}
+	err = dataset.AddRows(rows...)
+	Expect(err).To(HaveOccurred())
+
+	// Derived fields can't refer to themselves or fields derived after them.
+	dataset.Table.Derived = []DerivedField{
+		{Field{"salary_m", "number"}, "salary_k / 1000"},
+		{Field{"salary_k", "number"}, "salary / 1000"},
+	}
+	err = dataset.AddRows(rows...)
+	Expect(err).To(MatchError("Invalid expression for field salary_m: Field salary_k is derived after it"))
+
+	// Array cells are available to expressions as arrays of their values.
+	tags, err := newCell(nil, []interface{}{"a", "b"}, &Field{Name: "tags", Type: "[]string"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating cell: %s", err.Error())
+	}
+	value, err := dataset.Table.rowScope(map[string]Cell{"tags": tags})("tags")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(value).To(Equal([]interface{}{"a", "b"}))
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	RegisterTestingT(t)
+	start := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC)
+	queries := []*Query{
+		{
+			Metrics: []Metric{
+				{Type: "mean", Field: "salary"},
+				{Type: "median", Field: "salary"},
+				{Type: "stdev", Field: "salary"},
+				{Type: "cardinality", Field: "salary"},
+			},
+			Bucket: &Bucket{
+				Field: &Field{Name: "location", Type: "string"},
+				Sort:  &SortOptions{Type: "alphabetical"},
+				Bucket: &Bucket{
+					Field: &Field{Name: "start_date", Type: "datetime"},
+					DatetimeOptions: &DatetimeBucketOptions{
+						Period:   Month,
+						Start:    &start,
+						Location: time.UTC,
+					},
+					Sort: &SortOptions{Type: "alphabetical"},
+				},
+			},
+		},
+		{
+			Metrics: []Metric{
+				{Type: "count", Field: "salary"},
+			},
+			Aggregations: map[string]*Query{
+				"ranges": {
+					Metrics: []Metric{{Type: "sum", Field: "salary"}},
+					Bucket: &Bucket{
+						Field: &Field{Name: "salary", Type: "number"},
+						RangeOptions: &RangeBucketOptions{
+							Period: []interface{}{50000, 100000, 150000, 200000},
+						},
+						Sort: &SortOptions{Type: "numerical"},
+					},
+				},
+			},
+			Bucket: &Bucket{
+				Field: &Field{Name: "department", Type: "string"},
+				Sort:  &SortOptions{Type: "alphabetical"},
+			},
+		},
+	}
+
+	// Repeat the rows so that each worker gets a decent chunk.
+	many := []map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		many = append(many, rows...)
+	}
+
+	for _, query := range queries {
+		serial := &Dataset{Table: table}
+		parallel := &Dataset{Table: table, Workers: 4}
+		for _, dataset := range []*Dataset{serial, parallel} {
+			err := dataset.AddRows(many...)
+			if err != nil {
+				t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+			}
+		}
+
+		expected, err := serial.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running query: %s", err.Error())
+		}
+		results, err := parallel.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running parallel query: %s", err.Error())
+		}
+		rm, _ := json.Marshal(*results)
+		em, _ := json.Marshal(*expected)
+		Expect(rm).To(MatchJSON(em))
+		Expect(results.Composition).To(HaveLen(len(expected.Composition)))
+	}
+}
+
+func TestRunContextCancelled(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "count", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{
+				Name: "location",
+				Type: "string",
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dataset.RunContext(ctx, query)
+	Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	Expect(err.Error()).To(ContainSubstring("aggregating"))
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	dataset.Workers = 2
+	_, err = dataset.RunContext(ctx, query)
+	Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+	results, err := dataset.RunContext(context.Background(), query)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(results.Buckets).To(HaveLen(2))
+}
+
+func TestLimits(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: table,
+	}
+
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "count", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{
+				Name: "location",
+				Type: "string",
+			},
+			Bucket: &Bucket{
+				Field: &Field{
+					Name: "start_date",
+					Type: "datetime",
+				},
+				DatetimeOptions: &DatetimeBucketOptions{
+					Period:   Month,
+					Start:    &start,
+					Location: time.UTC,
+				},
+			},
+		},
+	}
+
+	// The query creates 2 location buckets, each with 15 months.
+	for _, example := range []struct {
+		limits  Limits
+		workers int
+		limit   string
+		field   string
+	}{
+		{Limits{MaxBuckets: 10}, 0, "MaxBuckets", "start_date"},
+		{Limits{MaxBuckets: 31}, 3, "MaxBuckets", "start_date"},
+		{Limits{MaxBucketsPerLevel: 1}, 0, "MaxBucketsPerLevel", "start_date"},
+		{Limits{MaxBucketsPerLevel: 1}, 3, "MaxBucketsPerLevel", "start_date"},
+		{Limits{MaxGapFill: 12}, 0, "MaxGapFill", "start_date"},
+	} {
+		dataset.Limits = &example.limits
+		dataset.Workers = example.workers
+		_, err = dataset.Run(query)
+		limitErr, ok := err.(*LimitError)
+		if !ok {
+			t.Fatalf("Expected *LimitError for %+v, got %v", example.limits, err)
+		}
+		Expect(limitErr.Limit).To(Equal(example.limit))
+		Expect(limitErr.Field).To(Equal(example.field))
+	}
+
+	dataset.Limits = &Limits{MaxBuckets: 32, MaxBucketsPerLevel: 15, MaxGapFill: 15}
+	results, err := dataset.Run(query)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(results.Buckets).To(HaveLen(2))
+
+	// Parallel workers share the limit while they aggregate. Without the gap
+	// fill start, each of the 3 chunks creates at most 4 buckets and the merged
+	// results hold 8, but the chunks create 9 between them.
+	query.Bucket.Bucket.DatetimeOptions.Start = nil
+	dataset.Limits = &Limits{MaxBuckets: 8}
+	dataset.Workers = 0
+	_, err = dataset.Run(query)
+	Expect(err).NotTo(HaveOccurred())
+	dataset.Workers = 3
+	_, err = dataset.Run(query)
+	limitErr, ok := err.(*LimitError)
+	if !ok {
+		t.Fatalf("Expected *LimitError for parallel workers, got %v", err)
+	}
+	Expect(limitErr.Limit).To(Equal("MaxBuckets"))
+}
+
+func TestLiveQuery(t *testing.T) {
+	RegisterTestingT(t)
+	// Columnar datasets are read from their columns, and rows added later.
+	for _, dataset := range []*Dataset{{Table: table}, {Table: table, Columns: &Columns{}}} {
+		testLiveQuery(t, dataset)
+	}
+}
+
+func testLiveQuery(t *testing.T, dataset *Dataset) {
+	err := dataset.AddRows(rows[:4]...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "mean", Field: "salary"},
+			{Type: "median", Field: "salary"},
+			{Type: "count", Field: "salary"},
+		},
+		Scripts: []BucketScript{
+			{Name: "double", Script: "salary:mean * 2"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "location", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field: &Field{Name: "start_date", Type: "datetime"},
+				DatetimeOptions: &DatetimeBucketOptions{
+					Period:   Month,
+					Location: time.UTC,
+				},
+				Sort: &SortOptions{Type: "alphabetical"},
+				Selectors: []BucketSelector{
+					{Metric: "salary:count", Operator: "gte", Value: 1},
+				},
+				Pipelines: []PipelineMetric{
+					{Type: "cumulative_sum", Metric: "salary:count"},
+				},
+			},
+		},
+	}
+
+	live, err := dataset.Live(query)
+	if err != nil {
+		t.Fatalf("Unexpected error creating live query: %s", err.Error())
+	}
+
+	// Live results should always match a full run over the same rows.
+	matchesRun := func() *Resultset {
+		results, err := live.Results()
+		if err != nil {
+			t.Fatalf("Unexpected error getting live results: %s", err.Error())
+		}
+		expected, err := dataset.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running query: %s", err.Error())
+		}
+		rm, _ := json.Marshal(*results)
+		em, _ := json.Marshal(*expected)
+		Expect(rm).To(MatchJSON(em))
+		return results
+	}
+
+	first := matchesRun()
+	firstJSON, _ := json.Marshal(*first)
+	Expect(first.Buckets).To(HaveLen(1))
+
+	for _, row := range rows[4:] {
+		err = dataset.AddRows(row)
+		if err != nil {
+			t.Fatalf("Unexpected error adding row: %s", err.Error())
+		}
+		matchesRun()
+	}
+
+	// Earlier results aren't changed by rows added later.
+	afterJSON, _ := json.Marshal(*first)
+	Expect(afterJSON).To(MatchJSON(firstJSON))
+
+	// Closed live queries are no longer updated.
+	last, _ := live.Results()
+	live.Close()
+	err = dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error adding rows: %s", err.Error())
+	}
+	closed, _ := live.Results()
+	lm, _ := json.Marshal(*last)
+	cm, _ := json.Marshal(*closed)
+	Expect(cm).To(MatchJSON(lm))
+}
+
+func TestLiveQueryConcurrentReads(t *testing.T) {
+	for _, dataset := range []*Dataset{{Table: table}, {Table: table, Columns: &Columns{}}} {
+		testLiveQueryConcurrentReads(t, dataset)
+	}
+}
+
+func testLiveQueryConcurrentReads(t *testing.T, dataset *Dataset) {
+	if err := dataset.AddRows(rows...); err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+	live, err := dataset.Live(&Query{
+		Metrics: []Metric{{Type: "sum", Field: "salary"}},
+		Bucket: &Bucket{
+			Field:  &Field{Name: "department", Type: "string"},
+			Bucket: &Bucket{Field: &Field{Name: "location", Type: "string"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating live query: %s", err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := dataset.AddRows(rows...); err != nil {
+				t.Errorf("Unexpected error adding rows: %s", err.Error())
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		results, err := live.Results()
+		if err != nil {
+			t.Fatalf("Unexpected error getting live results: %s", err.Error())
+		}
+		// Margins read the rows while more are being added.
+		if _, err := TabulateWithOptions(results, 1, &TabulateOptions{Margins: true}); err != nil {
+			t.Fatalf("Unexpected error tabulating live results: %s", err.Error())
+		}
+	}
+	<-done
+
+	results, err := live.Results()
+	if err != nil {
+		t.Fatalf("Unexpected error getting live results: %s", err.Error())
+	}
+	total := 0.0
+	for _, bucket := range results.Buckets {
+		for _, nested := range bucket.Buckets {
+			total += nested.Metrics["salary:sum"].(float64)
+		}
+	}
+	if total != 21*840000 {
+		t.Fatalf("Unexpected total salary: %f", total)
+	}
+}
+
+func TestMergePartials(t *testing.T) {
+	RegisterTestingT(t)
+	start := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC)
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "mean", Field: "salary"},
+			{Type: "median", Field: "salary"},
+			{Type: "stdev", Field: "salary"},
+			{Type: "cardinality", Field: "salary"},
+			{Type: "min", Field: "salary"},
+			{Type: "max", Field: "salary"},
+			{Type: "count", Field: "salary"},
+		},
+		Aggregations: map[string]*Query{
+			"ranges": {
+				Metrics: []Metric{{Type: "sum", Field: "salary"}},
+				Bucket: &Bucket{
+					Field: &Field{Name: "salary", Type: "number"},
+					RangeOptions: &RangeBucketOptions{
+						Period: []interface{}{50000, 100000, 150000, 200000},
+					},
+					Sort: &SortOptions{Type: "numerical"},
+				},
+			},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "department", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field: &Field{Name: "start_date", Type: "datetime"},
+				DatetimeOptions: &DatetimeBucketOptions{
+					Period:   Month,
+					Start:    &start,
+					Location: time.UTC,
+				},
+				Sort: &SortOptions{Type: "alphabetical"},
+			},
+		},
+	}
+
+	full := &Dataset{Table: table}
+	err := full.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+	expected, err := full.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	// Shard the rows by location, sending each partial through JSON.
+	partials := []*PartialResultset{}
+	for _, shard := range [][]map[string]interface{}{rows[:4], rows[4:]} {
+		dataset := &Dataset{Table: table}
+		err := dataset.AddRows(shard...)
+		if err != nil {
+			t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+		}
+		partial, err := dataset.RunPartial(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running partial query: %s", err.Error())
+		}
+		encoded, err := json.Marshal(partial)
+		if err != nil {
+			t.Fatalf("Unexpected error encoding partial: %s", err.Error())
+		}
+		decoded := &PartialResultset{}
+		err = json.Unmarshal(encoded, decoded)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding partial: %s", err.Error())
+		}
+		partials = append(partials, decoded)
+	}
+
+	results, err := Merge(query, partials...)
+	if err != nil {
+		t.Fatalf("Unexpected error merging partials: %s", err.Error())
+	}
+	rm, _ := json.Marshal(*results)
+	em, _ := json.Marshal(*expected)
+	Expect(rm).To(MatchJSON(em))
+
+	// Partials must match the query they're merged with.
+	_, err = Merge(&Query{Metrics: query.Metrics, Bucket: query.Bucket}, partials...)
+	Expect(err).To(MatchError("Partial aggregation ranges is not in the query"))
+	_, err = Merge(&Query{Bucket: &Bucket{Field: &Field{Name: "department", Type: "string"}}}, partials...)
+	Expect(err).To(MatchError("Partial bucket 2016-01-01T00:00:00Z is deeper than the query"))
+
+	// Stdev states are summarised rather than holding every value.
+	state := partials[0].Buckets[0].Buckets[0].States["salary:stdev"]
+	Expect(state.Values).To(BeEmpty())
+	Expect(state.SumSquares).NotTo(BeNil())
+
+	// Merge rejects the same invalid queries as Run.
+	invalid := &Query{Bucket: &Bucket{Field: &Field{Name: "start_date", Type: "datetime"}}}
+	_, runErr := full.Run(invalid)
+	Expect(runErr).To(MatchError("Bucketing by datetime without DatetimeOptions set"))
+	_, err = Merge(invalid, partials...)
+	Expect(err).To(MatchError(runErr.Error()))
+
+	// Gaps are only filled where Run would fill them, so an empty dataset
+	// has no range buckets either way.
+	empty := &Dataset{Table: table}
+	query = query.Aggregations["ranges"]
+	expected, err = empty.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	partial, err := empty.RunPartial(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running partial query: %s", err.Error())
+	}
+	results, err = Merge(query, partial)
+	if err != nil {
+		t.Fatalf("Unexpected error merging partials: %s", err.Error())
+	}
+	rm, _ = json.Marshal(*results)
+	em, _ = json.Marshal(*expected)
+	Expect(rm).To(MatchJSON(em))
+}
+
+func TestColumnarMatchesRows(t *testing.T) {
+	RegisterTestingT(t)
+	start := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC)
+	queries := []*Query{
+		{
+			Metrics: []Metric{
+				{Type: "mean", Field: "salary"},
+				{Type: "median", Field: "salary"},
+				{Type: "cardinality", Field: "department"},
+				{Type: "count", Field: "department"},
+			},
+			Bucket: &Bucket{
+				Field: &Field{Name: "location", Type: "string"},
+				Sort:  &SortOptions{Type: "alphabetical"},
+				Bucket: &Bucket{
+					Field: &Field{Name: "start_date", Type: "datetime"},
+					DatetimeOptions: &DatetimeBucketOptions{
+						Period:   Month,
+						Start:    &start,
+						Location: time.UTC,
+					},
+					Sort: &SortOptions{Type: "alphabetical"},
+				},
+			},
+		},
+		{
+			Metrics: []Metric{
+				{Type: "sum", Field: "salary"},
+			},
+			Bucket: &Bucket{
+				FiltersOptions: &FiltersBucketOptions{
+					Filters: map[string]*Filter{
+						"senior":      {Field: "salary", Operator: "gte", Value: 120000},
+						"engineering": {Field: "department", Operator: "eq", Value: "Engineering"},
+					},
+				},
+				Sort: &SortOptions{Type: "alphabetical"},
+				Bucket: &Bucket{
+					Field: &Field{Name: "salary", Type: "number"},
+					RangeOptions: &RangeBucketOptions{
+						Period: []interface{}{50000, 100000, 150000, 200000},
+					},
+					Sort: &SortOptions{Type: "numerical"},
+				},
+			},
+		},
+	}
+
+	// Include a row with missing values, which columns track separately.
+	data := append([]map[string]interface{}{
+		{"location": "Auckland", "department": nil, "salary": nil, "start_date": nil},
+	}, rows...)
+
+	for _, query := range queries {
+		rowSet := &Dataset{Table: table}
+		columnSet := &Dataset{Table: table, Columns: &Columns{}}
+		parallelSet := &Dataset{Table: table, Columns: &Columns{}, Workers: 3}
+		for _, dataset := range []*Dataset{rowSet, columnSet, parallelSet} {
+			err := dataset.AddRows(data...)
+			if err != nil {
+				t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+			}
+		}
+		Expect(columnSet.Rows).To(BeEmpty())
+		Expect(columnSet.Columns.Len()).To(Equal(len(data)))
+
+		expected, err := rowSet.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running query: %s", err.Error())
+		}
+		em, _ := json.Marshal(*expected)
+		for _, dataset := range []*Dataset{columnSet, parallelSet} {
+			results, err := dataset.Run(query)
+			if err != nil {
+				t.Fatalf("Unexpected error running columnar query: %s", err.Error())
+			}
+			rm, _ := json.Marshal(*results)
+			Expect(rm).To(MatchJSON(em))
+		}
+	}
+}
+
+func TestColumnarDatetimes(t *testing.T) {
+	RegisterTestingT(t)
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %s", err.Error())
+	}
+	dataset := &Dataset{
+		Table:   &Table{Fields: []Field{{"event", "string"}, {"date", "datetime"}}},
+		Columns: &Columns{},
+	}
+	// Datetimes outside the range of Unix nanoseconds keep their location.
+	dates := []time.Time{
+		time.Date(1600, 5, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2016, 2, 14, 10, 30, 0, 0, auckland),
+		time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for _, date := range dates {
+		err = dataset.AddRows(map[string]interface{}{"event": "launch", "date": date})
+		if err != nil {
+			t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+		}
+	}
+	for i, date := range dates {
+		value := dataset.Columns.Row(i)["date"].(*DatetimeCell).Value().(*time.Time)
+		Expect(value.Equal(date)).To(BeTrue())
+		Expect(value.Location()).To(Equal(date.Location()))
+	}
+
+	results, err := dataset.Run(&Query{
+		Metrics: []Metric{{Type: "count", Field: "event"}},
+		Bucket: &Bucket{
+			FilterOptions: &FilterBucketOptions{
+				Value:  "early",
+				Filter: &Filter{Field: "date", Operator: "lt", Value: "1700-01-01T00:00:00Z"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	Expect(results.Buckets).To(HaveLen(1))
+	Expect(results.Buckets[0].Metrics["event:count"]).To(Equal(1))
+}
+
+func TestDatasetSnapshot(t *testing.T) {
+	RegisterTestingT(t)
+	derivedTable := &Table{
+		Fields: table.Fields,
+		Derived: []DerivedField{
+			{Field: Field{Name: "monthly", Type: "number"}, Expression: "salary / 12"},
+			{Field: Field{Name: "senior", Type: "boolean"}, Expression: "salary >= 120000"},
+		},
+	}
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "sum", Field: "monthly"},
+			{Type: "count", Field: "senior"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "location", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field:           &Field{Name: "start_date", Type: "datetime"},
+				DatetimeOptions: &DatetimeBucketOptions{Period: Month, Location: time.UTC},
+				Sort:            &SortOptions{Type: "alphabetical"},
+			},
+		},
+	}
+	data := append([]map[string]interface{}{
+		{"location": "Auckland", "department": nil, "salary": 100000.125, "start_date": nil},
+	}, rows...)
+
+	for _, columns := range []*Columns{nil, {}} {
+		dataset := &Dataset{Table: derivedTable, Columns: columns}
+		err := dataset.AddRows(data...)
+		if err != nil {
+			t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+		}
+		expected, err := dataset.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running query: %s", err.Error())
+		}
+
+		buf := &bytes.Buffer{}
+		n, err := dataset.WriteTo(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error writing snapshot: %s", err.Error())
+		}
+		Expect(n).To(Equal(int64(buf.Len())))
+		snapshot := buf.Bytes()
+
+		loaded, err := ReadDataset(bytes.NewReader(snapshot))
+		if err != nil {
+			t.Fatalf("Unexpected error reading snapshot: %s", err.Error())
+		}
+		Expect(loaded.Table).To(Equal(derivedTable))
+		Expect(loaded.Columns != nil).To(Equal(columns != nil))
+		results, err := loaded.Run(query)
+		if err != nil {
+			t.Fatalf("Unexpected error running query on loaded dataset: %s", err.Error())
+		}
+		rm, _ := json.Marshal(*results)
+		em, _ := json.Marshal(*expected)
+		Expect(rm).To(MatchJSON(em))
+
+		// Decimal values are kept exactly.
+		value, _ := loaded.source().field("monthly")(0)
+		Expect(value.(*decimal.Decimal).String()).To(Equal("8333.34375"))
+
+		// Corruption is detected by the checksum, truncation by running out.
+		corrupt := append([]byte{}, snapshot...)
+		corrupt[len(corrupt)/2] ^= 0xff
+		_, err = ReadDataset(bytes.NewReader(corrupt))
+		Expect(err).To(HaveOccurred())
+		_, err = ReadDataset(bytes.NewReader(snapshot[:len(snapshot)-8]))
+		Expect(err).To(MatchError("Invalid dataset snapshot: unexpected end of data"))
+	}
+
+	_, err := ReadDataset(bytes.NewReader([]byte("NOT A SNAPSHOT")))
+	Expect(err).To(MatchError("Invalid dataset snapshot: missing header"))
+	_, err = ReadDataset(bytes.NewReader([]byte("AGGRO\x02")))
+	Expect(err).To(MatchError("Unsupported dataset snapshot version 2"))
+}
+
+func TestLenientRowErrors(t *testing.T) {
+	RegisterTestingT(t)
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "mean", Field: "salary"},
+			{Type: "mean", Field: "department"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "location", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+		},
+		Aggregations: map[string]*Query{
+			// Datetimes can't be bucketed without DatetimeOptions.
+			"starts": {
+				Bucket: &Bucket{Field: &Field{Name: "start_date", Type: "string"}},
+			},
+		},
+	}
+
+	dataset := &Dataset{Table: table}
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+	_, err = dataset.Run(query)
+	Expect(err).To(MatchError("Non aggregatable cell found without DatetimeOptions at depth 0, index 0"))
+
+	// A lenient query skips the bad cells, keeping what it can.
+	dataset.Lenient = &LenientOptions{}
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running lenient query: %s", err.Error())
+	}
+	rm, _ := json.Marshal(results.Buckets)
+	Expect(rm).To(MatchJSON(`[
+		{"value": "Auckland", "metrics": {"salary:mean": 110000, "department:mean": null}, "buckets": null},
+		{"value": "Wellington", "metrics": {"salary:mean": 133333.33333333334, "department:mean": null}, "buckets": null}
+	]`))
+	Expect(results.Aggregations["starts"].Buckets).To(BeEmpty())
+	Expect(results.Errors).To(HaveLen(8))
+	Expect(results.Errors[1]).To(Equal(&RowError{
+		Row:    0,
+		Field:  "start_date",
+		Reason: "Non aggregatable cell found without DatetimeOptions at depth 0, index 0",
+	}))
+
+	// The metric can't measure any of the field's cells, so it is reported
+	// once rather than for each row.
+	Expect(results.Errors[0]).To(Equal(&RowError{
+		Row:    -1,
+		Field:  "department",
+		Metric: "department:mean",
+		Reason: "Non metricable cell found (`department:mean`)",
+	}))
+	Expect(results.Errors[0]).To(MatchError("Metric department:mean skipped: Non metricable cell found (`department:mean`)"))
+	em, _ := json.Marshal(results.Errors[0])
+	Expect(em).To(MatchJSON(`{"row": -1, "field": "department", "metric": "department:mean", "reason": "Non metricable cell found (` + "`department:mean`" + `)"}`))
+
+	// Only so many errors are kept.
+	dataset.Lenient = &LenientOptions{MaxErrors: 3}
+	dataset.Workers = 3
+	results, err = dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running lenient query: %s", err.Error())
+	}
+	Expect(results.Errors).To(HaveLen(3))
+}
+
+func TestIngest(t *testing.T) {
+	RegisterTestingT(t)
+	data := []map[string]interface{}{
+		rows[0],
+		{"location": "Auckland", "department": "Marketing", "salary": "lots", "start_date": "2016-01-31T22:00:00Z"},
+		{"location": "Wellington", "department": "Engineering", "salary": 120000},
+		rows[1],
+	}
+
+	// By default nothing is added if any row is invalid.
+	dataset := &Dataset{Table: table}
+	report, err := dataset.Ingest(nil, data...)
+	Expect(err).To(MatchError("Rejected 2 of 4 rows, so none were added"))
+	Expect(dataset.Rows).To(BeEmpty())
+	Expect(report.Added).To(Equal(0))
+	rm, _ := json.Marshal(report.Rejected)
+	Expect(rm).To(MatchJSON(`[
+		{"row": 1, "field": "salary", "reason": "Expected number, got string"},
+		{"row": 2, "field": "start_date", "reason": "Data key start_date not present"}
+	]`))
+	Expect(report.Rejected[1]).To(MatchError("Error adding row 2, cell 3: Data key start_date not present"))
+
+	// Invalid rows can be skipped instead, with missing keys treated as nil.
+	report, err = dataset.Ingest(&IngestOptions{Mode: "skip_invalid", MissingAsNil: true}, data...)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting rows: %s", err.Error())
+	}
+	Expect(report.Added).To(Equal(3))
+	Expect(report.Rejected).To(HaveLen(1))
+	Expect(report.Rejected[0].Row).To(Equal(1))
+	Expect(dataset.Rows).To(HaveLen(3))
+	Expect(dataset.Rows[1]).ToNot(HaveKey("start_date"))
+
+	_, err = dataset.Ingest(&IngestOptions{Mode: "best_effort"}, data...)
+	Expect(err).To(MatchError("Unknown ingest mode: best_effort"))
+
+	// AddRows adds nothing if any row is invalid, returning the first.
+	dataset = &Dataset{Table: table}
+	err = dataset.AddRows(data...)
+	Expect(err).To(MatchError("Error adding row 1, cell 2: Expected number, got string"))
+	Expect(dataset.Rows).To(BeEmpty())
+}
+
+func TestBucketKeys(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{Table: table}
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "count", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field:           &Field{Name: "start_date", Type: "datetime"},
+			DatetimeOptions: &DatetimeBucketOptions{Period: Month, Location: time.UTC},
+			Sort:            &SortOptions{Type: "numerical", Desc: true},
+			Bucket: &Bucket{
+				Field: &Field{Name: "salary", Type: "number"},
+				RangeOptions: &RangeBucketOptions{
+					Period: []interface{}{100000, 150000, 200000},
+				},
+				Sort: &SortOptions{Type: "numerical"},
+			},
+		},
+	}
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	// Datetime keys sort chronologically and number keys numerically.
+	keys := []interface{}{}
+	for _, bucket := range results.Buckets {
+		keys = append(keys, bucket.Key)
+		Expect(bucket.Label).To(Equal(bucket.Value))
+	}
+	Expect(keys).To(Equal([]interface{}{
+		time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+	}))
+	ranges := []string{}
+	for _, bucket := range results.Buckets[2].Buckets {
+		Expect(bucket.Key).To(BeAssignableToTypeOf(decimal.Decimal{}))
+		ranges = append(ranges, bucket.Key.(decimal.Decimal).String())
+	}
+	Expect(ranges).To(Equal([]string{"100000", "150000", "200000"}))
+
+	// The JSON still has the string value of each key.
+	js, err := json.Marshal(results.Buckets[0])
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling results: %s", err.Error())
+	}
+	Expect(js).To(MatchJSON(`{
+		"value": "2016-03-01T00:00:00Z",
+		"metrics": null,
+		"buckets": [
+			{"value": "100000", "metrics": {"salary:count": 1}, "buckets": null},
+			{"value": "150000", "metrics": null, "buckets": null},
+			{"value": "200000", "metrics": {"salary:count": 1}, "buckets": null}
+		]
+	}`))
+
+	// Merged partials have their keys parsed from their values.
+	partial, err := dataset.RunPartial(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running partial query: %s", err.Error())
+	}
+	merged, err := Merge(query, partial)
+	if err != nil {
+		t.Fatalf("Unexpected error merging partials: %s", err.Error())
+	}
+	Expect(merged.Buckets[0].Key).To(Equal(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)))
+	Expect(merged.Buckets[0].Buckets[1].Key.(decimal.Decimal).String()).To(Equal("150000"))
+}
+
+func TestBucketByBoolean(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: &Table{
+			Fields: []Field{
+				{"department", "string"},
+				{"active", "boolean"},
+				{"remote", "boolean"},
+			},
+		},
+	}
+	_, err := dataset.Ingest(&IngestOptions{MissingAsNil: true},
+		map[string]interface{}{"department": "Engineering", "active": true, "remote": true},
+		map[string]interface{}{"department": "Engineering", "active": true, "remote": false},
+		map[string]interface{}{"department": "Engineering", "active": false, "remote": true},
+		map[string]interface{}{"department": "Marketing", "active": true, "remote": false},
+		map[string]interface{}{"department": "Marketing", "remote": false},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "true_count", Field: "remote"},
+			{Type: "false_count", Field: "remote"},
+			{Type: "true_ratio", Field: "remote"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "active", Type: "boolean"},
+			BooleanOptions: &BooleanBucketOptions{
+				TrueLabel:  "Active",
+				FalseLabel: "Inactive",
+				Missing:    true,
+			},
+			Sort: &SortOptions{Type: "alphabetical"},
+		},
+	}
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	labels := []string{}
+	for _, bucket := range results.Buckets {
+		labels = append(labels, bucket.Label)
+	}
+	// The missing bucket comes after the values, however they are sorted.
+	Expect(labels).To(Equal([]string{"Inactive", "Active", "missing"}))
+	Expect(results.Buckets[1].Key).To(Equal(true))
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling results: %s", err.Error())
+	}
+	Expect(js).To(MatchJSON(`{
+		"errors": null,
+		"buckets": [
+			{"value": "false", "metrics": {"remote:true_count": 1, "remote:false_count": 0, "remote:true_ratio": 1}, "buckets": null},
+			{"value": "true", "metrics": {"remote:true_count": 1, "remote:false_count": 2, "remote:true_ratio": 0.3333333333333333}, "buckets": null},
+			{"value": "", "metrics": {"remote:true_count": 0, "remote:false_count": 1, "remote:true_ratio": 0}, "buckets": null}
+		]
+	}`))
+
+	query.Bucket.Sort = &SortOptions{Type: "numerical", Desc: true}
+	results, err = dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	Expect(results.Buckets[0].Value).To(Equal("true"))
+	Expect(results.Buckets[2].Key).To(BeNil())
+	Expect(results.Buckets[2].Label).To(Equal("missing"))
+	query.Bucket.Sort = &SortOptions{Type: "alphabetical"}
+
+	// Tables keep buckets that share a label apart, titling them by label.
+	tableResults, err := dataset.Run(&Query{
+		Metrics: []Metric{{Type: "true_count", Field: "remote"}},
+		Bucket: &Bucket{
+			Field: &Field{Name: "department", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field: &Field{Name: "active", Type: "boolean"},
+				BooleanOptions: &BooleanBucketOptions{
+					FalseLabel:   "No",
+					Missing:      true,
+					MissingLabel: "No",
+				},
+				Sort: &SortOptions{Type: "alphabetical"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	resultTable, err := Tabulate(tableResults, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error converting results: %s", err.Error())
+	}
+	Expect(resultTable.ColumnTitles).To(Equal([][]string{{"No"}, {"true"}, {"No"}}))
+	Expect(resultTable.Rows[1][2]).To(Equal(map[string]interface{}{"remote:true_count": 0}))
+
+	// Boolean metrics can't be run on other fields.
+	_, err = dataset.Run(&Query{
+		Metrics: []Metric{{Type: "true_ratio", Field: "department"}},
+		Bucket:  &Bucket{Field: &Field{Name: "active", Type: "boolean"}},
+	})
+	Expect(err).To(MatchError("Non metricable cell found (`department:true_ratio`)"))
+
+	// Partial states merge to the same metrics.
+	partial, err := dataset.RunPartial(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running partial query: %s", err.Error())
+	}
+	merged, err := Merge(query, partial, partial)
+	if err != nil {
+		t.Fatalf("Unexpected error merging partials: %s", err.Error())
+	}
+	Expect(merged.Buckets[1].Label).To(Equal("Active"))
+	Expect(merged.Buckets[1].Metrics["remote:true_count"]).To(Equal(2))
+	Expect(merged.Buckets[1].Metrics["remote:true_ratio"]).To(BeNumerically("~", 1.0/3))
+	Expect(merged.Buckets[2].Key).To(BeNil())
+	Expect(merged.Buckets[2].Metrics["remote:false_count"]).To(Equal(2))
+
+	// A real value of missing is kept apart from the rows without a value.
+	statuses := &Dataset{Table: &Table{Fields: []Field{{"status", "string"}}}}
+	_, err = statuses.Ingest(&IngestOptions{MissingAsNil: true},
+		map[string]interface{}{"status": "missing"},
+		map[string]interface{}{"status": "missing"},
+		map[string]interface{}{},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+	results, err = statuses.Run(&Query{
+		Metrics: []Metric{{Type: "count", Field: "status"}},
+		Bucket: &Bucket{
+			Field:          &Field{Name: "status", Type: "string"},
+			BooleanOptions: &BooleanBucketOptions{Missing: true},
+			Sort:           &SortOptions{Type: "alphabetical"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	Expect(results.Buckets).To(HaveLen(2))
+	Expect(results.Buckets[0].Key).To(Equal("missing"))
+	Expect(results.Buckets[0].Metrics["status:count"]).To(Equal(2))
+	Expect(results.Buckets[1].Key).To(BeNil())
+	Expect(results.Buckets[1].Label).To(Equal("missing"))
+}
+
+func TestBucketByNumberTerms(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{
+		Table: &Table{
+			Fields: []Field{
+				{"grade", "number"},
+				{"score", "number"},
+			},
+		},
+	}
+	grades := []map[string]interface{}{
+		{"grade": 10, "score": 80},
+		{"grade": 2, "score": 60},
+		{"grade": 10.0, "score": 90},
+		{"grade": 9, "score": 70},
+		{"grade": 2.5, "score": 50},
+	}
+	err := dataset.AddRows(grades...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "mean", Field: "score"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "grade", Type: "number"},
+			Sort:  &SortOptions{Type: "numerical"},
+		},
+	}
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	js, err := json.Marshal(results.Buckets)
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling results: %s", err.Error())
+	}
+	// Numbers sort numerically rather than alphabetically, and equal numbers
+	// share a bucket.
+	Expect(js).To(MatchJSON(`[
+		{"value": "2", "metrics": {"score:mean": 60}, "buckets": null},
+		{"value": "2.5", "metrics": {"score:mean": 50}, "buckets": null},
+		{"value": "9", "metrics": {"score:mean": 70}, "buckets": null},
+		{"value": "10", "metrics": {"score:mean": 85}, "buckets": null}
+	]`))
+
+	// Columnar datasets give the same buckets.
+	columnar := &Dataset{Table: dataset.Table, Columns: &Columns{}}
+	err = columnar.AddRows(grades...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating columnar dataset: %s", err.Error())
+	}
+	columnarResults, err := columnar.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running columnar query: %s", err.Error())
+	}
+	cjs, _ := json.Marshal(columnarResults.Buckets)
+	Expect(cjs).To(MatchJSON(js))
+}
+
+func TestArrayFields(t *testing.T) {
+	RegisterTestingT(t)
+	arrayTable := &Table{
+		Fields: []Field{
+			{"name", "string"},
+			{"skills", "[]string"},
+			{"ratings", "[]number"},
+		},
+	}
+	arrayRows := []map[string]interface{}{
+		{"name": "Ana", "skills": []string{"go", "rust"}, "ratings": []int{4, 5}},
+		{"name": "Ben", "skills": []interface{}{"go", "go"}, "ratings": []float64{3}},
+		{"name": "Cat", "skills": []string{"python"}, "ratings": []int{}},
+		{"name": "Dan", "skills": nil, "ratings": []int{2}},
+	}
+
+	dataset := &Dataset{Table: arrayTable}
+	err := dataset.AddRows(arrayRows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+
+	err = dataset.AddRows(map[string]interface{}{"name": "Eve", "skills": "go", "ratings": nil})
+	Expect(err).To(MatchError("Error adding row 0, cell 1: Expected array, got string"))
+	err = dataset.AddRows(map[string]interface{}{"name": "Eve", "skills": []interface{}{"go", 1}, "ratings": nil})
+	Expect(err).To(MatchError("Error adding row 0, cell 1: Invalid element at index 1: Expected string datatype, got int"))
+
+	query := &Query{
+		Metrics: []Metric{
+			{Type: "count", Field: "ratings"},
+			{Type: "mean", Field: "ratings"},
+			{Type: "cardinality", Field: "skills"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "skills", Type: "[]string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+		},
+		Aggregations: map[string]*Query{
+			"rust": {
+				Metrics: []Metric{{Type: "count", Field: "name"}},
+				Bucket: &Bucket{
+					FilterOptions: &FilterBucketOptions{
+						Value:  "rust",
+						Filter: &Filter{Field: "skills", Operator: "contains_any", Value: []string{"rust", "java"}},
+					},
+				},
+			},
+			"go and rust": {
+				Metrics: []Metric{{Type: "count", Field: "name"}},
+				Bucket: &Bucket{
+					FilterOptions: &FilterBucketOptions{
+						Value:  "go and rust",
+						Filter: &Filter{Field: "skills", Operator: "contains_all", Value: []string{"go", "rust"}},
+					},
+				},
+			},
+			"rated 5": {
+				Metrics: []Metric{{Type: "count", Field: "name"}},
+				Bucket: &Bucket{
+					FilterOptions: &FilterBucketOptions{
+						Value:  "rated 5",
+						Filter: &Filter{Field: "ratings", Operator: "eq", Value: 5},
+					},
+				},
+			},
+			// Only arrays without a go element match, not those with any
+			// element other than go.
+			"not go": {
+				Metrics: []Metric{{Type: "count", Field: "name"}},
+				Bucket: &Bucket{
+					FilterOptions: &FilterBucketOptions{
+						Value:  "not go",
+						Filter: &Filter{Field: "skills", Operator: "ne", Value: "go"},
+					},
+				},
+			},
+		},
+	}
+
+	expected := `{
+		"errors": null,
+		"buckets": [
+			{"value": "go", "metrics": {"ratings:count": 3, "ratings:mean": 4, "skills:cardinality": 2}, "buckets": null},
+			{"value": "python", "metrics": {"ratings:count": 0, "ratings:mean": null, "skills:cardinality": 1}, "buckets": null},
+			{"value": "rust", "metrics": {"ratings:count": 2, "ratings:mean": 4.5, "skills:cardinality": 2}, "buckets": null}
+		],
+		"aggregations": {
+			"rust": {"errors": null, "buckets": [{"value": "rust", "metrics": {"name:count": 1}, "buckets": null}]},
+			"go and rust": {"errors": null, "buckets": [{"value": "go and rust", "metrics": {"name:count": 1}, "buckets": null}]},
+			"rated 5": {"errors": null, "buckets": [{"value": "rated 5", "metrics": {"name:count": 1}, "buckets": null}]},
+			"not go": {"errors": null, "buckets": [{"value": "not go", "metrics": {"name:count": 1}, "buckets": null}]}
+		}
+	}`
+	results, err := dataset.Run(query)
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	js, _ := json.Marshal(results)
+	Expect(js).To(MatchJSON(expected))
+
+	// Columnar datasets and snapshots hold arrays too.
+	columnar := &Dataset{Table: arrayTable, Columns: &Columns{}}
+	err = columnar.AddRows(arrayRows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating columnar dataset: %s", err.Error())
+	}
+	for _, set := range []*Dataset{dataset, columnar} {
+		buf := &bytes.Buffer{}
+		if _, err := set.WriteTo(buf); err != nil {
+			t.Fatalf("Unexpected error writing snapshot: %s", err.Error())
+		}
+		read, err := ReadDataset(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error reading snapshot: %s", err.Error())
+		}
+		for _, set := range []*Dataset{set, read} {
+			results, err := set.Run(query)
+			if err != nil {
+				t.Fatalf("Unexpected error running query: %s", err.Error())
+			}
+			js, _ := json.Marshal(results)
+			Expect(js).To(MatchJSON(expected))
+		}
+	}
+
+	_, err = dataset.Run(&Query{
+		Bucket: &Bucket{
+			FilterOptions: &FilterBucketOptions{
+				Value:  "go",
+				Filter: &Filter{Field: "skills", Operator: "contains_any", Value: "go"},
+			},
+		},
+	})
+	Expect(err).To(MatchError("Invalid filter value for field skills: Expected array, got string"))
+}
+
+func TestNestedFieldPaths(t *testing.T) {
+	RegisterTestingT(t)
+	type manager struct {
+		ID   string `json:"id"`
+		Name string
+	}
+	dataset := &Dataset{
+		Table: &Table{
+			Fields: []Field{
+				{"address.city", "string"},
+				{"manager.id", "string"},
+				{"manager.Name", "string"},
+				{"salary", "number"},
+			},
+		},
+	}
+	report, err := dataset.Ingest(&IngestOptions{Mode: "skip_invalid"},
+		map[string]interface{}{
+			"address": map[string]interface{}{"city": "Auckland"},
+			"manager": manager{ID: "m1", Name: "Mia"},
+			"salary":  100,
+		},
+		map[string]interface{}{
+			"address": map[string]interface{}{"city": "Wellington"},
+			"manager": &manager{ID: "m2", Name: "Max"},
+			"salary":  200,
+		},
+		// Missing and nil intermediate objects are nil values.
+		map[string]interface{}{
+			"manager": nil,
+			"salary":  300,
+		},
+		// A key for the whole name is used as it is.
+		map[string]interface{}{
+			"address.city": "Auckland",
+			"manager":      map[string]string{"id": "m1", "Name": "Mia"},
+			"salary":       400,
+		},
+		// Objects without the final key are missing it.
+		map[string]interface{}{
+			"address": map[string]interface{}{"street": "Queen St"},
+			"manager": manager{},
+			"salary":  500,
+		},
+	)
+	Expect(err).To(BeNil())
+	Expect(report.Added).To(Equal(4))
+	Expect(report.Rejected).To(Equal([]*RejectedRow{
+		{Row: 4, Field: "address.city", Reason: "Data key address.city not present", cell: 0},
+	}))
+
+	results, err := dataset.Run(&Query{
+		Metrics: []Metric{{Type: "sum", Field: "salary"}},
+		Bucket: &Bucket{
+			Field: &Field{Name: "address.city", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field: &Field{Name: "manager.id", Type: "string"},
+				Sort:  &SortOptions{Type: "alphabetical"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+	js, _ := json.Marshal(results.Buckets)
+	Expect(js).To(MatchJSON(`[
+		{"value": "Auckland", "metrics": null, "buckets": [
+			{"value": "m1", "metrics": {"salary:sum": 500}, "buckets": null}
+		]},
+		{"value": "Wellington", "metrics": null, "buckets": [
+			{"value": "m2", "metrics": {"salary:sum": 200}, "buckets": null}
+		]}
+	]`))
+	Expect(dataset.Rows[1]["manager.Name"].MeasurableCell().Value()).To(Equal("Max"))
+	Expect(dataset.Rows[2]).NotTo(HaveKey("address.city"))
+}
@@ -0,0 +1,118 @@
+package aggro
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// arrayTypePrefix marks a field type as an array of the type that follows it,
+// e.g. []string. A row's data for an array field may be any slice or array
+// whose elements are valid values for the element type.
+const arrayTypePrefix = "[]"
+
+// elementType returns the type of the elements of an array field type, or the
+// field type itself if it isn't an array.
+func elementType(fieldType string) string {
+	if isArrayType(fieldType) {
+		return fieldType[len(arrayTypePrefix):]
+	}
+	return fieldType
+}
+
+// isArrayType determines whether the field type is an array type.
+func isArrayType(fieldType string) bool {
+	return len(fieldType) > len(arrayTypePrefix) && fieldType[:len(arrayTypePrefix)] == arrayTypePrefix
+}
+
+// elementField returns the field that each element of the array field is a
+// value of.
+func elementField(field *Field) *Field {
+	return &Field{Name: field.Name, Type: elementType(field.Type)}
+}
+
+// sliceElements returns the elements of a slice or array, or false if the
+// datum is neither.
+func sliceElements(datum interface{}) ([]interface{}, bool) {
+	if elements, ok := datum.([]interface{}); ok {
+		return elements, true
+	}
+	value := reflect.ValueOf(datum)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, false
+	}
+	elements := make([]interface{}, value.Len())
+	for i := range elements {
+		elements[i] = value.Index(i).Interface()
+	}
+	return elements, true
+}
+
+// newArrayCell constructs an ArrayCell for the array field, with a cell of the
+// element type for each element of the datum.
+func newArrayCell(data, datum interface{}, field *Field) (Cell, error) {
+	values, ok := sliceElements(datum)
+	if !ok {
+		return nil, fmt.Errorf("Expected array, got %T", datum)
+	}
+	cell := &ArrayCell{
+		elements: make([]Cell, len(values)),
+		field:    field,
+		element:  elementField(field),
+		data:     data,
+	}
+	for i, value := range values {
+		if value == nil {
+			return nil, fmt.Errorf("Got nil element at index %d", i)
+		}
+		element, err := newCell(data, value, cell.element)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid element at index %d: %s", i, err.Error())
+		}
+		cell.elements[i] = element
+	}
+	return cell, nil
+}
+
+// ArrayCell implements the Cell{} interface for array fields, holding a cell
+// for each element.
+type ArrayCell struct {
+	elements []Cell
+	field    *Field
+	element  *Field
+	data     interface{}
+}
+
+// FieldDefinition returns the field definition (name) representing the cell.
+func (cell *ArrayCell) FieldDefinition() *Field {
+	return cell.field
+}
+
+// IsMetricable determines whether the measurer{} provided can be run by the
+// cell, which it can if it can be run on each of the cell's elements.
+func (cell *ArrayCell) IsMetricable(m measurer) bool {
+	switch cell.element.Type {
+	case fieldTypeString:
+		return (&StringCell{}).IsMetricable(m)
+	case fieldTypeNumber:
+		return (&NumberCell{}).IsMetricable(m)
+	case fieldTypeDatetime:
+		return (&DatetimeCell{}).IsMetricable(m)
+	case fieldTypeBoolean:
+		return (&BooleanCell{}).IsMetricable(m)
+	}
+	return false
+}
+
+// Value returns the value of each element of the cell.
+func (cell *ArrayCell) Value() interface{} {
+	values := make([]interface{}, len(cell.elements))
+	for i, element := range cell.elements {
+		values[i], _ = cellValue(element)
+	}
+	return values
+}
+
+// MeasurableCell returns the cells MeasurableCell{}.
+func (cell *ArrayCell) MeasurableCell() MeasurableCell {
+	return cell
+}
@@ -1,6 +1,7 @@
 package aggro
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -18,6 +19,10 @@ const (
 // newCell constructs a Cell{} based on the given *Field.Type. Data being assigned to the *Field
 // must be of the same datatype as *Field.Type.
 func newCell(data, datum interface{}, field *Field) (Cell, error) {
+	if isArrayType(field.Type) {
+		return newArrayCell(data, datum, field)
+	}
+
 	var cell Cell
 
 	switch field.Type {
@@ -62,15 +67,29 @@ func newCell(data, datum interface{}, field *Field) (Cell, error) {
 		var d decimal.Decimal
 		switch datumTyped := datum.(type) {
 		case int:
-			d = decimal.NewFromFloat(float64(datumTyped))
+			d = decimal.New(int64(datumTyped), 0)
 		case int32:
-			d = decimal.NewFromFloat(float64(datumTyped))
+			d = decimal.New(int64(datumTyped), 0)
 		case int64:
-			d = decimal.NewFromFloat(float64(datumTyped))
+			d = decimal.New(datumTyped, 0)
 		case float32:
 			d = decimal.NewFromFloat(float64(datumTyped))
 		case float64:
 			d = decimal.NewFromFloat(datumTyped)
+		case json.Number:
+			// Decoded JSON numbers are converted exactly, without a float64.
+			var err error
+			d, err = decimal.NewFromString(string(datumTyped))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid number %s", datumTyped)
+			}
+		case decimal.Decimal:
+			d = datumTyped
+		case *decimal.Decimal:
+			if datumTyped == nil {
+				return nil, errors.New("Got nil *decimal.Decimal for number field")
+			}
+			d = *datumTyped
 		default:
 			return nil, fmt.Errorf("Expected number, got %T", datum)
 		}
@@ -119,7 +138,9 @@ func (cell *NumberCell) FieldDefinition() *Field {
 
 // IsMetricable determines whether the measurer{} provided can be run by the cell.
 func (cell *NumberCell) IsMetricable(m measurer) bool {
-	return true
+	// Every metric but the boolean ones can run on NumberCells.
+	_, isBoolean := m.(*booleanCount)
+	return !isBoolean
 }
 
 // Value returns the cell value.
@@ -219,7 +240,7 @@ func (cell *BooleanCell) FieldDefinition() *Field {
 func (cell *BooleanCell) IsMetricable(m measurer) bool {
 	// We allow certain metrics to run on BooleanCells.
 	switch m.(type) {
-	case *valueCount:
+	case *valueCount, *booleanCount:
 		return true
 	default:
 		return false
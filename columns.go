@@ -0,0 +1,274 @@
+package aggro
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Columns stores a Dataset's rows field by field, rather than as a map of cells
+// per row. Each field's values are held in a slice of their type: strings are
+// dictionary encoded, booleans and nils are held in bitmaps, and arrays are held
+// as slices of their element values. Queries, including their filters, read
+// values straight from the columns rather than building each row's cells.
+//
+// Columns don't keep the data each row was added from, so the Composition of
+// results run against them is empty.
+type Columns struct {
+	columns map[string]*column
+	size    int
+}
+
+// column holds the values of a single field. Only the slices for the field's
+// type are used.
+type column struct {
+	field *Field
+	// nils has a bit set for each row without a value.
+	nils       bitmap
+	codes      []uint32
+	dictionary []string
+	lookup     map[string]uint32
+	numbers    []decimal.Decimal
+	// Datetimes are held as Unix seconds and nanoseconds, which reach beyond
+	// the years that Unix nanoseconds alone can, and the index of their
+	// location in locations.
+	seconds   []int64
+	nanos     []int32
+	zones     []uint16
+	locations []*time.Location
+	booleans  bitmap
+	arrays    [][]interface{}
+}
+
+// bitmap is a growable set of bits.
+type bitmap []uint64
+
+func (b bitmap) get(i int) bool {
+	word := i / 64
+	return word < len(b) && b[word]&(1<<uint(i%64)) != 0
+}
+
+func (b *bitmap) set(i int) {
+	word := i / 64
+	for len(*b) <= word {
+		*b = append(*b, 0)
+	}
+	(*b)[word] |= 1 << uint(i%64)
+}
+
+// Len returns the number of rows in the columns.
+func (c *Columns) Len() int {
+	return c.size
+}
+
+// append adds a row of cells.
+func (c *Columns) append(table *Table, row map[string]Cell) {
+	c.init(table)
+	for _, col := range c.columns {
+		value, _ := cellValue(row[col.field.Name])
+		col.append(c.size, value)
+	}
+	c.size++
+}
+
+// appendValues adds a row of values, one for each of the table's stored and
+// derived fields in order, of the same type as their cell's Value.
+func (c *Columns) appendValues(table *Table, values []interface{}) {
+	c.init(table)
+	for i, field := range snapshotFields(table) {
+		c.columns[field.Name].append(c.size, values[i])
+	}
+	c.size++
+}
+
+// init creates the columns for the table's fields on first use.
+func (c *Columns) init(table *Table) {
+	if c.columns == nil {
+		c.columns = map[string]*column{}
+		for i := range table.Fields {
+			c.columns[table.Fields[i].Name] = &column{field: &table.Fields[i]}
+		}
+		for i := range table.Derived {
+			c.columns[table.Derived[i].Name] = &column{field: &table.Derived[i].Field}
+		}
+	}
+}
+
+// append adds the value at index, which must be the column's length. The value
+// is of the same type as the field's cell Value, or nil.
+func (col *column) append(index int, value interface{}) {
+	if value == nil {
+		col.nils.set(index)
+	}
+	if isArrayType(col.field.Type) {
+		var elements []interface{}
+		if value != nil {
+			elements = value.([]interface{})
+		}
+		col.arrays = append(col.arrays, elements)
+		return
+	}
+	switch col.field.Type {
+	case fieldTypeString:
+		code := uint32(0)
+		if value != nil {
+			value := value.(string)
+			var ok bool
+			code, ok = col.lookup[value]
+			if !ok {
+				if col.lookup == nil {
+					col.lookup = map[string]uint32{}
+				}
+				code = uint32(len(col.dictionary))
+				col.dictionary = append(col.dictionary, value)
+				col.lookup[value] = code
+			}
+		}
+		col.codes = append(col.codes, code)
+	case fieldTypeNumber:
+		number := decimal.Decimal{}
+		if value != nil {
+			number = *value.(*decimal.Decimal)
+		}
+		col.numbers = append(col.numbers, number)
+	case fieldTypeDatetime:
+		datetime := time.Time{}
+		if value != nil {
+			datetime = *value.(*time.Time)
+		}
+		col.seconds = append(col.seconds, datetime.Unix())
+		col.nanos = append(col.nanos, int32(datetime.Nanosecond()))
+		col.zones = append(col.zones, col.zone(datetime.Location()))
+	case fieldTypeBoolean:
+		if value != nil && value.(bool) {
+			col.booleans.set(index)
+		}
+	}
+}
+
+// zone returns the index of the location in the column's locations, adding it
+// if it's new. A dataset rarely has more than a few locations, so they're
+// searched in order.
+func (col *column) zone(location *time.Location) uint16 {
+	for i, l := range col.locations {
+		if l == location {
+			return uint16(i)
+		}
+	}
+	col.locations = append(col.locations, location)
+	return uint16(len(col.locations) - 1)
+}
+
+// value returns the value of the column at index, of the same type as its
+// cell's Value, or nil if there isn't one.
+func (col *column) value(index int) interface{} {
+	if col.nils.get(index) {
+		return nil
+	}
+	if isArrayType(col.field.Type) {
+		return col.arrays[index]
+	}
+	switch col.field.Type {
+	case fieldTypeString:
+		return col.dictionary[col.codes[index]]
+	case fieldTypeNumber:
+		return &col.numbers[index]
+	case fieldTypeDatetime:
+		datetime := time.Unix(col.seconds[index], int64(col.nanos[index])).In(col.locations[col.zones[index]])
+		return &datetime
+	case fieldTypeBoolean:
+		return col.booleans.get(index)
+	}
+	return nil
+}
+
+// Row builds the cells of the row at index.
+func (c *Columns) Row(index int) map[string]Cell {
+	row := map[string]Cell{}
+	for name, col := range c.columns {
+		if value := col.value(index); value != nil {
+			// Values read from a column are always valid for its field.
+			row[name], _ = newCell(nil, value, col.field)
+		}
+	}
+	return row
+}
+
+// rowSource is the storage that a query reads a dataset's rows from, either a
+// slice of rows or Columns.
+type rowSource interface {
+	length() int
+	// field returns a reader of the named field's values, resolving the field
+	// once rather than for every row read.
+	field(name string) fieldReader
+}
+
+// fieldReader returns the value of a field in the row at index, of the same
+// type as its cell's Value, along with the data the row was added from. The
+// value is nil if the row has no value for the field.
+type fieldReader func(index int) (interface{}, interface{})
+
+// rowSlice is a rowSource of rows held as maps of cells.
+type rowSlice []map[string]Cell
+
+func (rows rowSlice) length() int {
+	return len(rows)
+}
+
+func (rows rowSlice) field(name string) fieldReader {
+	return func(index int) (interface{}, interface{}) {
+		return cellValue(rows[index][name])
+	}
+}
+
+// cellValue returns the cell's Value and the data it was created from, or nils
+// if there is no cell.
+func cellValue(cell Cell) (interface{}, interface{}) {
+	switch cell := cell.(type) {
+	case *StringCell:
+		return cell.value, cell.data
+	case *NumberCell:
+		return cell.value, cell.data
+	case *DatetimeCell:
+		return cell.value, cell.data
+	case *BooleanCell:
+		return cell.value, cell.data
+	case *ArrayCell:
+		return cell.Value(), cell.data
+	}
+	return nil, nil
+}
+
+func (c *Columns) length() int {
+	return c.size
+}
+
+func (c *Columns) field(name string) fieldReader {
+	col := c.columns[name]
+	if col == nil {
+		return func(int) (interface{}, interface{}) {
+			return nil, nil
+		}
+	}
+	return func(index int) (interface{}, interface{}) {
+		return col.value(index), nil
+	}
+}
+
+// view returns a copy of the columns that isn't changed as rows are appended
+// to them. Appending only writes beyond the end of each slice, so the values
+// are shared, but the bitmaps are copied as their last word may be written.
+func (c *Columns) view() *Columns {
+	view := &Columns{size: c.size}
+	if c.columns == nil {
+		return view
+	}
+	view.columns = make(map[string]*column, len(c.columns))
+	for name, col := range c.columns {
+		copied := *col
+		copied.nils = append(bitmap(nil), col.nils...)
+		copied.booleans = append(bitmap(nil), col.booleans...)
+		view.columns[name] = &copied
+	}
+	return view
+}
@@ -0,0 +1,178 @@
+package aggro
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/shopspring/decimal"
+)
+
+// WriteCSV writes the table to w as CSV in a pivot layout. The row titles form
+// the leading columns, and the column titles form a header row for each level,
+// followed by a header row of metric names. Each column title has a column for
+// each metric. The metrics are given by key, e.g. salary:mean, and default to
+// every metric found in the table's cells, in alphabetical order.
+func (table *ResultTable) WriteCSV(w io.Writer, metrics ...string) error {
+	if len(metrics) == 0 {
+		cells := []map[string]interface{}{}
+		for _, row := range table.Rows {
+			cells = append(cells, row...)
+		}
+		metrics = metricKeys(cells)
+	}
+	rowDepth := titleDepth(table.RowTitles)
+	columnDepth := titleDepth(table.ColumnTitles)
+
+	writer := csv.NewWriter(w)
+
+	// A header row for each level of the column titles, then the metrics.
+	for level := 0; level <= columnDepth; level++ {
+		record := make([]string, rowDepth, rowDepth+len(table.ColumnTitles)*len(metrics))
+		for _, column := range table.ColumnTitles {
+			for _, metric := range metrics {
+				switch {
+				case level == columnDepth:
+					record = append(record, metric)
+				case level < len(column):
+					record = append(record, column[level])
+				default:
+					record = append(record, "")
+				}
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	for i, row := range table.Rows {
+		record := make([]string, rowDepth, rowDepth+len(row)*len(metrics))
+		copy(record, table.RowTitles[i])
+		for _, cell := range row {
+			for _, metric := range metrics {
+				record = append(record, formatCSVValue(cell[metric]))
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteCSV writes the results to w as CSV in a long layout, with a line for
+// each tip bucket. Each line has the value of the bucket and each of its
+// parents, followed by the bucket's metrics. The header names the bucket
+// columns from the query's buckets, and the metrics are given by key, e.g.
+// salary:mean, defaulting to every metric found in the tip buckets in
+// alphabetical order. Sibling aggregations aren't included, but can be written
+// on their own with their query.
+func (results *Resultset) WriteCSV(w io.Writer, query *Query, metrics ...string) error {
+	// Gather the path to each tip bucket, in order.
+	paths := [][]*ResultBucket{}
+	var walk func(path []*ResultBucket, buckets []*ResultBucket)
+	walk = func(path []*ResultBucket, buckets []*ResultBucket) {
+		for _, bucket := range buckets {
+			bucketPath := append(path[:len(path):len(path)], bucket)
+			if len(bucket.Buckets) == 0 {
+				paths = append(paths, bucketPath)
+				continue
+			}
+			walk(bucketPath, bucket.Buckets)
+		}
+	}
+	walk(nil, results.Buckets)
+
+	if len(metrics) == 0 {
+		cells := make([]map[string]interface{}, len(paths))
+		for i, path := range paths {
+			cells[i] = path[len(path)-1].Metrics
+		}
+		metrics = metricKeys(cells)
+	}
+
+	writer := csv.NewWriter(w)
+	header := []string{}
+	for bucket := query.Bucket; bucket != nil; bucket = bucket.Bucket {
+		header = append(header, bucketName(bucket))
+	}
+	depth := len(header)
+	header = append(header, metrics...)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if len(path) > depth {
+			return errors.New("Results are deeper than the query's buckets")
+		}
+		record := make([]string, depth, depth+len(metrics))
+		for i, bucket := range path {
+			record[i] = bucket.Value
+		}
+		tip := path[len(path)-1]
+		for _, metric := range metrics {
+			record = append(record, formatCSVValue(tip.Metrics[metric]))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// metricKeys returns every metric key in the cells, in alphabetical order.
+func metricKeys(cells []map[string]interface{}) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, cell := range cells {
+		for key := range cell {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// titleDepth returns the number of levels in the longest title.
+func titleDepth(titles [][]string) int {
+	depth := 0
+	for _, title := range titles {
+		if len(title) > depth {
+			depth = len(title)
+		}
+	}
+	return depth
+}
+
+// formatCSVValue formats a metric value for a CSV field. Missing values are
+// empty.
+func formatCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case decimal.Decimal:
+		return v.String()
+	case *decimal.Decimal:
+		if v == nil {
+			return ""
+		}
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,59 @@
+package aggro
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestResultTableWriteCSV(t *testing.T) {
+	RegisterTestingT(t)
+	_, results := departmentResults(t, []Metric{{Type: "max", Field: "salary"}, {Type: "count", Field: "salary"}}, nil)
+	table, err := Tabulate(results, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error converting results: %s", err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	err = table.WriteCSV(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error writing CSV: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`,Engineering,Engineering,Marketing,Marketing
+,salary:count,salary:max,salary:count,salary:max
+Auckland,2,120000,2,150000
+Wellington,3,160000,,
+`))
+
+	// Metrics can be chosen and ordered.
+	buf.Reset()
+	err = table.WriteCSV(buf, "salary:max")
+	if err != nil {
+		t.Fatalf("Unexpected error writing CSV: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`,Engineering,Marketing
+,salary:max,salary:max
+Auckland,120000,150000
+Wellington,160000,
+`))
+}
+
+func TestResultsetWriteCSV(t *testing.T) {
+	RegisterTestingT(t)
+	query, results := departmentResults(t, []Metric{{Type: "max", Field: "salary"}, {Type: "count", Field: "salary"}}, nil)
+
+	buf := &bytes.Buffer{}
+	err := results.WriteCSV(buf, query, "salary:max", "salary:count")
+	if err != nil {
+		t.Fatalf("Unexpected error writing CSV: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`location,department,salary:max,salary:count
+Auckland,Engineering,120000,2
+Auckland,Marketing,150000,2
+Wellington,Engineering,160000,3
+`))
+
+	err = results.WriteCSV(buf, &Query{Bucket: query.Bucket.Bucket})
+	Expect(err).To(MatchError("Results are deeper than the query's buckets"))
+}
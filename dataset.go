@@ -1,6 +1,7 @@
 package aggro
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -8,41 +9,107 @@ import (
 type Dataset struct {
 	Table *Table
 	Rows  []map[string]Cell
+	// Columns, if set, stores rows added with AddRows by field rather than in
+	// Rows, and queries read from it instead of Rows. See Columns.
+	Columns *Columns
+	// Workers is the number of goroutines a query is run with. The rows are
+	// split into a chunk per worker and aggregated concurrently, then the tip
+	// buckets are measured concurrently. Values below 2 run queries serially.
+	Workers int
+	// Limits, if set, cause queries that would create too many result buckets
+	// to fail early with a *LimitError.
+	Limits *Limits
+	// Lenient, if set, makes queries skip rows and cells that can't be
+	// aggregated or measured rather than failing, recording a *RowError for
+	// each in the Resultset's Errors.
+	Lenient *LenientOptions
+	// live are the live queries updated as rows are added.
+	live []*LiveQuery
 }
 
 // Run executes the query against the dataset.
 func (set *Dataset) Run(query *Query) (*Resultset, error) {
+	return set.RunContext(context.Background(), query)
+}
+
+// RunContext executes the query against the dataset, stopping early if the
+// context is cancelled or its deadline passes. The context's error is returned
+// wrapped with the phase of the query that was running at the time.
+func (set *Dataset) RunContext(ctx context.Context, query *Query) (*Resultset, error) {
 	return (&queryProcessor{
+		ctx:     ctx,
 		dataset: set,
 		query:   query,
 	}).Run()
 }
 
 // AddRows creates a Cell{} for each of our Table.Fields and ensures the cells data
-// meets the cells defined format.
+// meets the cells defined format. If any row is invalid none are added, and the
+// first invalid row is returned as a *RejectedRow. Any live queries are updated
+// with the rows.
 func (set *Dataset) AddRows(rows ...map[string]interface{}) error {
+	report, err := set.Ingest(nil, rows...)
+	if err != nil && report != nil && len(report.Rejected) > 0 {
+		return report.Rejected[0]
+	}
+	return err
+}
+
+// newRow creates the cells of the row at index i from its data. Missing keys
+// are treated as nil values if missingAsNil is set.
+func (set *Dataset) newRow(i int, data map[string]interface{}, expressions []expression, missingAsNil bool) (map[string]Cell, *RejectedRow) {
+	row := map[string]Cell{}
 	var err error
-	// Add each row.
-	for i, data := range rows {
-		row := map[string]Cell{}
-		// For each row, we need to create a cell for each field definition and
-		// ensure that we have received data that conforms to the supposed format.
-		for j, field := range set.Table.Fields {
-			datum, ok := data[field.Name]
-			if !ok {
-				return fmt.Errorf("Error adding row %d, cell %d: Data key %s not present", i, j, field.Name)
-			}
-			if datum == nil {
-				// Skip if datum is nil
-				continue
-			}
-
-			row[field.Name], err = newCell(data, datum, &field)
-			if err != nil {
-				return fmt.Errorf("Error adding row %d, cell %d: %s", i, j, err.Error())
-			}
+	// For each row, we need to create a cell for each field definition and
+	// ensure that we have received data that conforms to the supposed format.
+	for j, field := range set.Table.Fields {
+		datum, ok := fieldValue(data, field.Name)
+		if !ok && !missingAsNil {
+			return nil, &RejectedRow{Row: i, Field: field.Name, Reason: fmt.Sprintf("Data key %s not present", field.Name), cell: j}
 		}
+		if datum == nil {
+			// Skip if datum is nil
+			continue
+		}
+
+		row[field.Name], err = newCell(data, datum, &field)
+		if err != nil {
+			return nil, &RejectedRow{Row: i, Field: field.Name, Reason: err.Error(), cell: j}
+		}
+	}
+
+	// Now that the stored cells exist, compute the derived cells in order.
+	scope := set.Table.rowScope(row)
+	for j := range set.Table.Derived {
+		field := &set.Table.Derived[j].Field
+		value, err := expressions[j].eval(scope)
+		if err != nil {
+			return nil, &RejectedRow{Row: i, Field: field.Name, Reason: err.Error(), cell: -1}
+		}
+		if value == nil {
+			continue
+		}
+		row[field.Name], err = newCell(data, value, field)
+		if err != nil {
+			return nil, &RejectedRow{Row: i, Field: field.Name, Reason: err.Error(), cell: -1}
+		}
+	}
+	return row, nil
+}
+
+// store appends a row of cells to the dataset's Columns, or Rows if it has none.
+func (set *Dataset) store(row map[string]Cell) {
+	if set.Columns != nil {
+		set.Columns.append(set.Table, row)
+	} else {
 		set.Rows = append(set.Rows, row)
 	}
-	return nil
+}
+
+// source returns the storage that queries read the dataset's rows from.
+func (set *Dataset) source() rowSource {
+	if set.Columns != nil {
+		return set.Columns
+	}
+	return rowSlice(set.Rows)
 }
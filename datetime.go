@@ -18,23 +18,33 @@ const (
 )
 
 func datetimeValueForPeriod(value *time.Time, period DatetimePeriod, location *time.Location) (string, error) {
+	key, err := datetimeKeyForPeriod(value, period, location)
+	if err != nil {
+		return "", err
+	}
+	return key.Format(time.RFC3339), nil
+}
+
+// datetimeKeyForPeriod returns the start of the period that the value falls
+// in, in the location.
+func datetimeKeyForPeriod(value *time.Time, period DatetimePeriod, location *time.Location) (time.Time, error) {
 	t := value.In(location)
 	switch period {
 	case Year:
-		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()).Format(time.RFC3339), nil
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()), nil
 	case Quarter:
 		// Get the month, but as a quarter start, rather than month start.
 		month := (((t.Month() - 1) / 3) * 3) + 1
-		return time.Date(t.Year(), month, 1, 0, 0, 0, 0, t.Location()).Format(time.RFC3339), nil
+		return time.Date(t.Year(), month, 1, 0, 0, 0, 0, t.Location()), nil
 	case Month:
-		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).Format(time.RFC3339), nil
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()), nil
 	case Week:
 		day := t.Day() - int(t.Weekday())
-		return time.Date(t.Year(), t.Month(), day, 0, 0, 0, 0, t.Location()).Format(time.RFC3339), nil
+		return time.Date(t.Year(), t.Month(), day, 0, 0, 0, 0, t.Location()), nil
 	case Day:
-		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Format(time.RFC3339), nil
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), nil
 	default:
-		return "", fmt.Errorf("Unknown datetime period: %s", period)
+		return time.Time{}, fmt.Errorf("Unknown datetime period: %s", period)
 	}
 }
 
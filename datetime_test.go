@@ -1,6 +1,7 @@
 package aggro
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -58,3 +59,35 @@ func TestDatetimePeriodWeek(t *testing.T) {
 		}
 	}
 }
+
+func TestDatetimeGapFillWithOnlyStart(t *testing.T) {
+	dataset := &Dataset{Table: table}
+	if err := dataset.AddRows(rows...); err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err)
+	}
+	// With a Start but no End, the end comes from the latest bucket.
+	start := time.Date(2015, 11, 15, 0, 0, 0, 0, time.UTC)
+	results, err := dataset.Run(&Query{
+		Metrics: []Metric{{Type: "count", Field: "salary"}},
+		Bucket: &Bucket{
+			Field: &Field{Name: "start_date", Type: "datetime"},
+			DatetimeOptions: &DatetimeBucketOptions{
+				Start:    &start,
+				Period:   Month,
+				Location: time.UTC,
+			},
+			Sort: &SortOptions{Type: "alphabetical"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err)
+	}
+	values := []string{}
+	for _, bucket := range results.Buckets {
+		values = append(values, bucket.Value)
+	}
+	expected := "[2015-11-01T00:00:00Z 2015-12-01T00:00:00Z 2016-01-01T00:00:00Z 2016-02-01T00:00:00Z 2016-03-01T00:00:00Z]"
+	if fmt.Sprint(values) != expected {
+		t.Fatalf("Unexpected buckets:\n\n\t%v did not equal expected %s", values, expected)
+	}
+}
@@ -0,0 +1,770 @@
+package aggro
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shopspring/decimal"
+)
+
+// Expressions are small formulas evaluated against either a result bucket's
+// metrics (bucket scripts) or a row's cells (derived fields). Identifiers are
+// resolved by name through an expressionScope; names that aren't plain words,
+// such as field names containing spaces, can be quoted with backticks.
+//
+// Values are one of nil, decimal.Decimal, string, bool or time.Time, or an
+// array of them read from an array field. Supported syntax, from lowest to
+// highest precedence:
+//
+//	a || b, a && b
+//	a == b, a != b, a < b, a <= b, a > b, a >= b
+//	a + b, a - b
+//	a * b, a / b, a % b
+//	-a, !a
+//	123.4, 'string', "string", true, false, null, name, fn(args...), (expr)
+//
+// Arithmetic with a null operand, and division by zero, result in null. Adding
+// two strings concatenates them, and subtracting two datetimes results in the
+// number of days between them. The available functions are listed in
+// expressionFunctions.
+
+// expression is a parsed expression, ready to evaluate.
+type expression interface {
+	eval(scope expressionScope) (interface{}, error)
+}
+
+// expressionScope resolves an identifier to its value.
+type expressionScope func(name string) (interface{}, error)
+
+// parseExpression parses the source into an evaluatable expression.
+func parseExpression(source string) (expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &expressionParser{source: source, tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := parser.peek(); tok.kind != tokenEOF {
+		return nil, parser.errorf(tok, "Unexpected %q", tok.text)
+	}
+	return expr, nil
+}
+
+// Lexing.
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lexExpression(source string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i]), start})
+		case r == '\'' || r == '"' || r == '`':
+			start := i
+			text := strings.Builder{}
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("Expression error at %d: Unterminated %c", start, r)
+			}
+			i++
+			kind := tokenString
+			if r == '`' {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, token{kind, text.String(), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_:.", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			start := i
+			op := string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			switch op {
+			case "+", "-", "*", "/", "%", "(", ")", "<", ">", "!", ",",
+				"==", "!=", "<=", ">=", "&&", "||":
+			default:
+				return nil, fmt.Errorf("Expression error at %d: Unexpected %q", start, op)
+			}
+			i += len(op)
+			tokens = append(tokens, token{tokenOperator, op, start})
+		}
+	}
+	return append(tokens, token{tokenEOF, "end of expression", len(runes)}), nil
+}
+
+// Parsing.
+
+type expressionParser struct {
+	source string
+	tokens []token
+	pos    int
+}
+
+func (parser *expressionParser) peek() token {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *expressionParser) next() token {
+	tok := parser.tokens[parser.pos]
+	if tok.kind != tokenEOF {
+		parser.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the given operators.
+func (parser *expressionParser) accept(operators ...string) (string, bool) {
+	tok := parser.peek()
+	if tok.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range operators {
+		if tok.text == op {
+			parser.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (parser *expressionParser) expect(operator string) error {
+	if _, ok := parser.accept(operator); !ok {
+		tok := parser.peek()
+		return parser.errorf(tok, "Expected %q, got %q", operator, tok.text)
+	}
+	return nil
+}
+
+func (parser *expressionParser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("Expression error at %d in `%s`: %s", tok.pos, parser.source, fmt.Sprintf(format, args...))
+}
+
+// parseBinary parses a left associative chain of the given operators, with
+// operands parsed by next.
+func (parser *expressionParser) parseBinary(next func() (expression, error), operators ...string) (expression, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := parser.accept(operators...)
+		if !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpression{op: op, left: left, right: right}
+	}
+}
+
+func (parser *expressionParser) parseOr() (expression, error) {
+	return parser.parseBinary(parser.parseAnd, "||")
+}
+
+func (parser *expressionParser) parseAnd() (expression, error) {
+	return parser.parseBinary(parser.parseComparison, "&&")
+}
+
+func (parser *expressionParser) parseComparison() (expression, error) {
+	return parser.parseBinary(parser.parseAdditive, "==", "!=", "<=", ">=", "<", ">")
+}
+
+func (parser *expressionParser) parseAdditive() (expression, error) {
+	return parser.parseBinary(parser.parseMultiplicative, "+", "-")
+}
+
+func (parser *expressionParser) parseMultiplicative() (expression, error) {
+	return parser.parseBinary(parser.parseUnary, "*", "/", "%")
+}
+
+func (parser *expressionParser) parseUnary() (expression, error) {
+	if op, ok := parser.accept("-", "!"); ok {
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpression{op: op, operand: operand}, nil
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *expressionParser) parsePrimary() (expression, error) {
+	tok := parser.next()
+	switch tok.kind {
+	case tokenNumber:
+		d, err := decimal.NewFromString(tok.text)
+		if err != nil {
+			return nil, parser.errorf(tok, "Invalid number %q", tok.text)
+		}
+		return &literalExpression{value: d}, nil
+	case tokenString:
+		return &literalExpression{value: tok.text}, nil
+	case tokenIdent:
+		// Identifiers followed by parentheses are function calls.
+		if _, ok := parser.accept("("); ok {
+			return parser.parseCall(tok)
+		}
+		switch tok.text {
+		case "true":
+			return &literalExpression{value: true}, nil
+		case "false":
+			return &literalExpression{value: false}, nil
+		case "null":
+			return &literalExpression{value: nil}, nil
+		}
+		return &identifierExpression{name: tok.text}, nil
+	case tokenOperator:
+		if tok.text == "(" {
+			expr, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := parser.expect(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		}
+	}
+	return nil, parser.errorf(tok, "Unexpected %q", tok.text)
+}
+
+func (parser *expressionParser) parseCall(name token) (expression, error) {
+	fn, ok := expressionFunctions[strings.ToLower(name.text)]
+	if !ok {
+		return nil, parser.errorf(name, "Unknown function %s", name.text)
+	}
+	call := &callExpression{name: name.text, fn: fn}
+	if _, ok := parser.accept(")"); ok {
+		return call, nil
+	}
+	for {
+		arg, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if _, ok := parser.accept(","); ok {
+			continue
+		}
+		if err := parser.expect(")"); err != nil {
+			return nil, err
+		}
+		return call, nil
+	}
+}
+
+// Evaluation.
+
+// expressionIdentifiers returns the names of the identifiers that the
+// expression refers to.
+func expressionIdentifiers(expr expression) []string {
+	switch e := expr.(type) {
+	case *identifierExpression:
+		return []string{e.name}
+	case *unaryExpression:
+		return expressionIdentifiers(e.operand)
+	case *binaryExpression:
+		return append(expressionIdentifiers(e.left), expressionIdentifiers(e.right)...)
+	case *callExpression:
+		names := []string{}
+		for _, arg := range e.args {
+			names = append(names, expressionIdentifiers(arg)...)
+		}
+		return names
+	}
+	return nil
+}
+
+type literalExpression struct {
+	value interface{}
+}
+
+func (expr *literalExpression) eval(scope expressionScope) (interface{}, error) {
+	return expr.value, nil
+}
+
+type identifierExpression struct {
+	name string
+}
+
+func (expr *identifierExpression) eval(scope expressionScope) (interface{}, error) {
+	return scope(expr.name)
+}
+
+type unaryExpression struct {
+	op      string
+	operand expression
+}
+
+func (expr *unaryExpression) eval(scope expressionScope) (interface{}, error) {
+	value, err := expr.operand.eval(scope)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	switch expr.op {
+	case "-":
+		d, ok := value.(decimal.Decimal)
+		if !ok {
+			return nil, fmt.Errorf("Cannot negate %s", describeValue(value))
+		}
+		return d.Neg(), nil
+	default:
+		b, err := truthy(value)
+		return !b, err
+	}
+}
+
+type binaryExpression struct {
+	op          string
+	left, right expression
+}
+
+func (expr *binaryExpression) eval(scope expressionScope) (interface{}, error) {
+	left, err := expr.left.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short circuit, so evaluate the right side lazily.
+	switch expr.op {
+	case "&&", "||":
+		l, err := truthy(left)
+		if err != nil || l == (expr.op == "||") {
+			return l, err
+		}
+		right, err := expr.right.eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		return truthy(right)
+	}
+
+	right, err := expr.right.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expr.op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return compareValues(expr.op, left, right)
+	}
+
+	// Arithmetic on null is null.
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	switch l := left.(type) {
+	case decimal.Decimal:
+		r, ok := right.(decimal.Decimal)
+		if !ok {
+			break
+		}
+		switch expr.op {
+		case "+":
+			return l.Add(r), nil
+		case "-":
+			return l.Sub(r), nil
+		case "*":
+			return l.Mul(r), nil
+		case "/":
+			if r.IsZero() {
+				return nil, nil
+			}
+			return l.DivRound(r, 16), nil
+		case "%":
+			if r.IsZero() {
+				return nil, nil
+			}
+			return l.Mod(r), nil
+		}
+	case string:
+		if r, ok := right.(string); ok && expr.op == "+" {
+			return l + r, nil
+		}
+	case time.Time:
+		if r, ok := right.(time.Time); ok && expr.op == "-" {
+			return decimal.NewFromFloat(l.Sub(r).Hours() / 24), nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot apply %s to %s and %s", expr.op, describeValue(left), describeValue(right))
+}
+
+type callExpression struct {
+	name string
+	fn   expressionFunction
+	args []expression
+}
+
+func (expr *callExpression) eval(scope expressionScope) (interface{}, error) {
+	value, err := expr.fn(scope, expr.args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", expr.name, err.Error())
+	}
+	return value, nil
+}
+
+// truthy converts a value to a boolean for conditions. Null is false.
+func truthy(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("Expected boolean, got %s", describeValue(value))
+}
+
+// compareValues compares two values of the same type. Null is only equal to
+// null, and is neither less than nor greater than anything.
+func compareValues(op string, left, right interface{}) (bool, error) {
+	if left == nil || right == nil {
+		switch op {
+		case "==":
+			return left == right, nil
+		case "!=":
+			return left != right, nil
+		}
+		return false, nil
+	}
+	cmp := 0
+	switch l := left.(type) {
+	case decimal.Decimal:
+		r, ok := right.(decimal.Decimal)
+		if !ok {
+			return false, fmt.Errorf("Cannot compare %s with %s", describeValue(left), describeValue(right))
+		}
+		cmp = l.Cmp(r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false, fmt.Errorf("Cannot compare %s with %s", describeValue(left), describeValue(right))
+		}
+		cmp = strings.Compare(l, r)
+	case time.Time:
+		r, ok := right.(time.Time)
+		if !ok {
+			return false, fmt.Errorf("Cannot compare %s with %s", describeValue(left), describeValue(right))
+		}
+		switch {
+		case l.Before(r):
+			cmp = -1
+		case l.After(r):
+			cmp = 1
+		}
+	case bool:
+		r, ok := right.(bool)
+		if !ok || (op != "==" && op != "!=") {
+			return false, fmt.Errorf("Cannot compare %s with %s using %s", describeValue(left), describeValue(right), op)
+		}
+		if l != r {
+			cmp = 1
+		}
+	default:
+		return false, fmt.Errorf("Cannot compare %s", describeValue(left))
+	}
+	switch op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// describeValue returns the expression type name of a value for errors.
+func describeValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case decimal.Decimal:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case time.Time:
+		return "datetime"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// formatValue converts a value to a string for concatenation.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case decimal.Decimal:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+// Functions.
+
+// expressionFunction evaluates a function call. Arguments are passed
+// unevaluated so that conditionals only evaluate the branch they need.
+type expressionFunction func(scope expressionScope, args []expression) (interface{}, error)
+
+// expressionFunctions are the functions that can be called in expressions.
+//
+//	if(condition, then, else)       then if the condition is true, otherwise else
+//	case(c1, v1, c2, v2, ..., else) the value of the first true condition, or else
+//	coalesce(a, b, ...)             the first argument that isn't null
+//	concat(a, b, ...)               the arguments joined as strings
+//	lower(s), upper(s)              the string in lower or upper case
+//	abs(n)                          the absolute value of n
+//	round(n, places)                n rounded to a number of decimal places
+//	now()                           the current datetime
+//	trunc(d, period)                d truncated to the start of a DatetimePeriod
+//	extract(d, part)                the year, quarter, month, week, day, weekday,
+//	                                hour or minute of d
+var expressionFunctions = map[string]expressionFunction{
+	"if":       expressionIf,
+	"case":     expressionCase,
+	"coalesce": expressionCoalesce,
+	"concat":   expressionConcat,
+	"lower":    stringFunction(strings.ToLower),
+	"upper":    stringFunction(strings.ToUpper),
+	"abs":      expressionAbs,
+	"round":    expressionRound,
+	"now":      expressionNow,
+	"trunc":    expressionTrunc,
+	"extract":  expressionExtract,
+}
+
+// evalArgs evaluates every argument, ensuring there are exactly count of them.
+func evalArgs(scope expressionScope, args []expression, count int) ([]interface{}, error) {
+	if count >= 0 && len(args) != count {
+		return nil, fmt.Errorf("Expected %d arguments, got %d", count, len(args))
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		value, err := arg.eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func expressionIf(scope expressionScope, args []expression) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("Expected 3 arguments, got %d", len(args))
+	}
+	return expressionCase(scope, args)
+}
+
+func expressionCase(scope expressionScope, args []expression) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Expected at least 2 arguments, got %d", len(args))
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		condition, err := args[i].eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := truthy(condition)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return args[i+1].eval(scope)
+		}
+	}
+	// An odd number of arguments has a default value.
+	if len(args)%2 == 1 {
+		return args[len(args)-1].eval(scope)
+	}
+	return nil, nil
+}
+
+func expressionCoalesce(scope expressionScope, args []expression) (interface{}, error) {
+	for _, arg := range args {
+		value, err := arg.eval(scope)
+		if err != nil || value != nil {
+			return value, err
+		}
+	}
+	return nil, nil
+}
+
+func expressionConcat(scope expressionScope, args []expression) (interface{}, error) {
+	values, err := evalArgs(scope, args, -1)
+	if err != nil {
+		return nil, err
+	}
+	result := strings.Builder{}
+	for _, value := range values {
+		result.WriteString(formatValue(value))
+	}
+	return result.String(), nil
+}
+
+func stringFunction(fn func(string) string) expressionFunction {
+	return func(scope expressionScope, args []expression) (interface{}, error) {
+		values, err := evalArgs(scope, args, 1)
+		if err != nil || values[0] == nil {
+			return nil, err
+		}
+		s, ok := values[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected string, got %s", describeValue(values[0]))
+		}
+		return fn(s), nil
+	}
+}
+
+func expressionAbs(scope expressionScope, args []expression) (interface{}, error) {
+	values, err := evalArgs(scope, args, 1)
+	if err != nil || values[0] == nil {
+		return nil, err
+	}
+	d, ok := values[0].(decimal.Decimal)
+	if !ok {
+		return nil, fmt.Errorf("Expected number, got %s", describeValue(values[0]))
+	}
+	return d.Abs(), nil
+}
+
+func expressionRound(scope expressionScope, args []expression) (interface{}, error) {
+	values, err := evalArgs(scope, args, 2)
+	if err != nil || values[0] == nil {
+		return nil, err
+	}
+	d, ok := values[0].(decimal.Decimal)
+	places, placesOk := values[1].(decimal.Decimal)
+	if !ok || !placesOk {
+		return nil, fmt.Errorf("Expected numbers, got %s and %s", describeValue(values[0]), describeValue(values[1]))
+	}
+	return d.Round(int32(places.IntPart())), nil
+}
+
+func expressionNow(scope expressionScope, args []expression) (interface{}, error) {
+	if _, err := evalArgs(scope, args, 0); err != nil {
+		return nil, err
+	}
+	return time.Now(), nil
+}
+
+// datetimeArgs evaluates a datetime and string argument pair.
+func datetimeArgs(scope expressionScope, args []expression) (*time.Time, string, error) {
+	values, err := evalArgs(scope, args, 2)
+	if err != nil || values[0] == nil {
+		return nil, "", err
+	}
+	t, ok := values[0].(time.Time)
+	part, partOk := values[1].(string)
+	if !ok || !partOk {
+		return nil, "", fmt.Errorf("Expected datetime and string, got %s and %s", describeValue(values[0]), describeValue(values[1]))
+	}
+	return &t, part, nil
+}
+
+// truncPeriods maps the period names accepted by trunc to the DatetimePeriod
+// they truncate to, as the names of the periods don't always match their
+// values.
+var truncPeriods = map[string]DatetimePeriod{
+	"year":    Year,
+	"quarter": Quarter,
+	"month":   Month,
+	"week":    Week,
+	"day":     Day,
+}
+
+func expressionTrunc(scope expressionScope, args []expression) (interface{}, error) {
+	t, name, err := datetimeArgs(scope, args)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	period, ok := truncPeriods[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown datetime period: %s", name)
+	}
+	return datetimeKeyForPeriod(t, period, t.Location())
+}
+
+func expressionExtract(scope expressionScope, args []expression) (interface{}, error) {
+	t, part, err := datetimeArgs(scope, args)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	var value int
+	switch part {
+	case "year":
+		value = t.Year()
+	case "quarter":
+		value = (int(t.Month())-1)/3 + 1
+	case "month":
+		value = int(t.Month())
+	case "week":
+		_, value = t.ISOWeek()
+	case "day":
+		value = t.Day()
+	case "weekday":
+		value = int(t.Weekday())
+	case "hour":
+		value = t.Hour()
+	case "minute":
+		value = t.Minute()
+	default:
+		return nil, fmt.Errorf("Unknown datetime part: %s", part)
+	}
+	return decimal.New(int64(value), 0), nil
+}
@@ -0,0 +1,109 @@
+package aggro
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestExpressionEval(t *testing.T) {
+	start := time.Date(2016, 2, 14, 10, 30, 0, 0, time.UTC)
+	scope := func(name string) (interface{}, error) {
+		switch name {
+		case "a":
+			return decimal.New(6, 0), nil
+		case "b":
+			return decimal.New(4, 0), nil
+		case "name":
+			return "Wellington", nil
+		case "start":
+			return start, nil
+		case "missing":
+			return nil, nil
+		}
+		return nil, nil
+	}
+	for _, example := range []struct {
+		source   string
+		expected interface{}
+	}{
+		{"a + b * 2", decimal.New(14, 0)},
+		{"(a + b) * 2", decimal.New(20, 0)},
+		{"a / b", decimal.RequireFromString("1.5")},
+		{"-a % b", decimal.New(-2, 0)},
+		{"a / 0", nil},
+		{"a + missing", nil},
+		{"coalesce(missing, b)", decimal.New(4, 0)},
+		{"missing == null", true},
+		{"missing > 1", false},
+		{"a > b && !(b > a)", true},
+		{"if(a < b, 'lt', 'gte')", "gte"},
+		{"case(a == 1, 'one', a == 6, 'six', 'other')", "six"},
+		{"case(a == 1, 'one')", nil},
+		{"lower(name) + '!'", "wellington!"},
+		{"concat(upper(name), '-', a)", "WELLINGTON-6"},
+		{"trunc(start, 'month')", time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"trunc(start, 'day')", time.Date(2016, 2, 14, 0, 0, 0, 0, time.UTC)},
+		{"extract(start, 'quarter') * 10 + extract(start, 'hour')", decimal.New(20, 0)},
+		{"start - trunc(start, 'year')", decimal.RequireFromString("44.4375")},
+		{"round(a / 7, 2)", decimal.RequireFromString("0.86")},
+		{"`a` * 1.5", decimal.New(9, 0)},
+	} {
+		expr, err := parseExpression(example.source)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", example.source, err)
+		}
+		result, err := expr.eval(scope)
+		if err != nil {
+			t.Fatalf("Unexpected error evaluating %s: %s", example.source, err)
+		}
+		switch expected := example.expected.(type) {
+		case decimal.Decimal:
+			if d, ok := result.(decimal.Decimal); !ok || !d.Equal(expected) {
+				t.Fatalf("Unexpected result for %s:\n\n\t%v did not equal expected %v", example.source, result, expected)
+			}
+		case time.Time:
+			if d, ok := result.(time.Time); !ok || !d.Equal(expected) {
+				t.Fatalf("Unexpected result for %s:\n\n\t%v did not equal expected %v", example.source, result, expected)
+			}
+		default:
+			if result != example.expected {
+				t.Fatalf("Unexpected result for %s:\n\n\t%v did not equal expected %v", example.source, result, expected)
+			}
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, source := range []string{
+		"a +",
+		"(a",
+		"a = b",
+		"unknown(a)",
+		"'unterminated",
+	} {
+		if _, err := parseExpression(source); err == nil {
+			t.Fatalf("Expected error parsing %s, got none", source)
+		}
+	}
+
+	scope := func(name string) (interface{}, error) {
+		return "text", nil
+	}
+	for _, source := range []string{
+		"if(a, b)",
+		"a - 1",
+		"a > 1",
+		"a && true",
+		"extract(a, 'year')",
+	} {
+		expr, err := parseExpression(source)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", source, err)
+		}
+		if _, err := expr.eval(scope); err == nil {
+			t.Fatalf("Expected error evaluating %s, got none", source)
+		}
+	}
+}
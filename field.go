@@ -2,6 +2,8 @@ package aggro
 
 // Field represents an individual Field within our Dataset.Table.
 type Field struct {
+	// Name is the key of the field's value in each row's data. A dotted name
+	// such as address.city is a path into nested objects; see fieldValue.
 	Name string
 	Type string
 }
@@ -0,0 +1,374 @@
+package aggro
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Filter is a predicate that a row can be tested against. A filter matches a
+// row when its own condition (if it has a Field) matches, all of the All filters
+// match, and at least one of the Any filters match (if any are supplied).
+type Filter struct {
+	// Field is the name of the field the condition is tested against.
+	Field string
+	// Operator is one of eq, ne, gt, gte, lt, lte, exists, missing,
+	// contains_any or contains_all. On an array field, eq, gt, gte, lt and lte
+	// match if any of its elements match, so gt matches an array whose largest
+	// element is greater than the value and lt one whose smallest is less. ne
+	// matches only if none of its elements are equal to the value.
+	Operator string
+	// Value is compared with the cell using the operator. It must be a valid
+	// value for the field's type, or of its elements if it is an array. For
+	// contains_any and contains_all it is a slice of values, of which the cell
+	// must hold at least one or all respectively.
+	Value interface{}
+	All   []*Filter
+	Any   []*Filter
+}
+
+// Match determines whether the row matches the filter. A nil filter matches
+// every row.
+func (filter *Filter) Match(row map[string]Cell) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	// A row only has cells for the fields it has values for, so any field may
+	// be missing from it.
+	field := func(name string) (*Field, error) {
+		if cell := row[name]; cell != nil {
+			return cell.FieldDefinition(), nil
+		}
+		return nil, nil
+	}
+	matcher, err := newFilterMatcher(field, filter)
+	if err != nil {
+		return false, err
+	}
+	return matcher.match(func(m *filterMatcher) interface{} {
+		value, _ := cellValue(row[m.filter.Field])
+		return value
+	})
+}
+
+// filterMatcher is a filter prepared for matching many rows, with its values
+// converted once to the type of the field they are compared with.
+type filterMatcher struct {
+	filter *Filter
+	// targets are the filter's values, of the same type as the field's cell
+	// values, or of its elements if it is an array.
+	targets []interface{}
+	// read is the reader of the field the condition tests, once bound to the
+	// rows it's matched against.
+	read fieldReader
+	all  []*filterMatcher
+	any  []*filterMatcher
+}
+
+// newFilterMatcher prepares the filter, and those nested in it, looking up the
+// fields they test with field, which returns an error for unknown fields.
+// Comparisons against a field without a definition never match.
+func newFilterMatcher(field func(name string) (*Field, error), filter *Filter) (*filterMatcher, error) {
+	matcher := &filterMatcher{filter: filter}
+	if filter.Field != "" {
+		if err := matcher.prepareCondition(field); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range filter.All {
+		m, err := newFilterMatcher(field, f)
+		if err != nil {
+			return nil, err
+		}
+		matcher.all = append(matcher.all, m)
+	}
+	for _, f := range filter.Any {
+		m, err := newFilterMatcher(field, f)
+		if err != nil {
+			return nil, err
+		}
+		matcher.any = append(matcher.any, m)
+	}
+	return matcher, nil
+}
+
+// prepareCondition checks the filter's own condition, converting its values to
+// the type of the field they are compared with.
+func (matcher *filterMatcher) prepareCondition(field func(name string) (*Field, error)) error {
+	filter := matcher.filter
+	switch filter.Operator {
+	case "eq", "ne", "gt", "gte", "lt", "lte", "exists", "missing", "contains_any", "contains_all":
+	default:
+		return fmt.Errorf("Unknown filter operator: %s", filter.Operator)
+	}
+	def, err := field(filter.Field)
+	if err != nil || def == nil {
+		return err
+	}
+	switch filter.Operator {
+	case "exists", "missing":
+	case "contains_any", "contains_all":
+		values, ok := sliceElements(filter.Value)
+		if !ok {
+			return fmt.Errorf("Invalid filter value for field %s: Expected array, got %T", filter.Field, filter.Value)
+		}
+		for _, value := range values {
+			target, err := filterTarget(filter.Field, def, value)
+			if err != nil {
+				return err
+			}
+			matcher.targets = append(matcher.targets, target)
+		}
+	default:
+		target, err := filterTarget(filter.Field, def, filter.Value)
+		if err != nil {
+			return err
+		}
+		matcher.targets = []interface{}{target}
+	}
+	return nil
+}
+
+// filterTarget converts a filter value to the type of the field's values, or
+// of its elements if it is an array.
+func filterTarget(name string, field *Field, value interface{}) (interface{}, error) {
+	if isArrayType(field.Type) {
+		field = elementField(field)
+	}
+	cell, err := newCell(nil, value, field)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter value for field %s: %s", name, err.Error())
+	}
+	target, _ := cellValue(cell)
+	return target, nil
+}
+
+// bind resolves the reader of the field each condition tests from the rows it
+// will be matched against.
+func (matcher *filterMatcher) bind(source rowSource) {
+	if matcher.filter.Field != "" {
+		matcher.read = source.field(matcher.filter.Field)
+	}
+	for _, m := range matcher.all {
+		m.bind(source)
+	}
+	for _, m := range matcher.any {
+		m.bind(source)
+	}
+}
+
+// match determines whether a row matches the filter, reading the row's value
+// of the field each condition tests with value.
+func (matcher *filterMatcher) match(value func(m *filterMatcher) interface{}) (bool, error) {
+	if matcher.filter.Field != "" {
+		ok, err := matcher.matchValue(value(matcher))
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, m := range matcher.all {
+		ok, err := m.match(value)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if len(matcher.any) == 0 {
+		return true, nil
+	}
+	for _, m := range matcher.any {
+		ok, err := m.match(value)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchValue tests the filter's condition against a single field's value.
+func (matcher *filterMatcher) matchValue(value interface{}) (bool, error) {
+	switch matcher.filter.Operator {
+	case "exists":
+		return value != nil, nil
+	case "missing":
+		return value == nil, nil
+	}
+
+	// Nil values never match a comparison.
+	if value == nil {
+		return false, nil
+	}
+
+	// A single value is treated as an array of one element.
+	elements, ok := value.([]interface{})
+	if !ok {
+		elements = []interface{}{value}
+	}
+
+	switch matcher.filter.Operator {
+	case "contains_any", "contains_all":
+		return matcher.matchContains(elements)
+	}
+
+	// Without the field's definition there is nothing to compare with.
+	if len(matcher.targets) == 0 {
+		return false, nil
+	}
+	// ne is the negation of eq, so must hold for every element.
+	operator, negate := matcher.filter.Operator, false
+	if operator == "ne" {
+		operator, negate = "eq", true
+	}
+	for _, element := range elements {
+		cmp, err := compareFilterValues(element, matcher.targets[0])
+		if err != nil {
+			return false, err
+		}
+		ok, err := matchOperator(operator, cmp)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return !negate, nil
+		}
+	}
+	return negate, nil
+}
+
+// matchContains determines whether the elements contain any or all of the
+// filter's values, depending on its operator.
+func (matcher *filterMatcher) matchContains(elements []interface{}) (bool, error) {
+	all := matcher.filter.Operator == "contains_all"
+	for _, target := range matcher.targets {
+		found := false
+		for _, element := range elements {
+			cmp, err := compareFilterValues(element, target)
+			if err != nil {
+				return false, err
+			}
+			if cmp == 0 {
+				found = true
+				break
+			}
+		}
+		if found != all {
+			// Any is satisfied by the first value found, and all fails on the
+			// first value missing.
+			return found, nil
+		}
+	}
+	return all, nil
+}
+
+// compareFilterValues compares two cell values of the same type, returning -1,
+// 0 or 1 if a is less than, equal to or greater than b.
+func compareFilterValues(a, b interface{}) (int, error) {
+	switch aTyped := a.(type) {
+	case *decimal.Decimal:
+		if bTyped, ok := b.(*decimal.Decimal); ok {
+			return aTyped.Cmp(*bTyped), nil
+		}
+	case string:
+		if bTyped, ok := b.(string); ok {
+			return strings.Compare(aTyped, bTyped), nil
+		}
+	case *time.Time:
+		if bTyped, ok := b.(*time.Time); ok {
+			switch {
+			case aTyped.Before(*bTyped):
+				return -1, nil
+			case aTyped.After(*bTyped):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case bool:
+		if bTyped, ok := b.(bool); ok {
+			switch {
+			case aTyped == bTyped:
+				return 0, nil
+			case bTyped:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, fmt.Errorf("Cannot compare %T with %T", a, b)
+}
+
+// matchOperator determines whether the result of a comparison satisfies the
+// operator.
+func matchOperator(operator string, cmp int) (bool, error) {
+	switch operator {
+	case "eq":
+		return cmp == 0, nil
+	case "ne":
+		return cmp != 0, nil
+	case "gt":
+		return cmp > 0, nil
+	case "gte":
+		return cmp >= 0, nil
+	case "lt":
+		return cmp < 0, nil
+	case "lte":
+		return cmp <= 0, nil
+	default:
+		return false, fmt.Errorf("Unknown filter operator: %s", operator)
+	}
+}
+
+// BucketSelector is a condition on a result bucket's metrics. Buckets that
+// don't satisfy all of their selectors are removed from the results.
+type BucketSelector struct {
+	// Metric is the key of the metric being tested, e.g. salary:mean, or count
+	// for the number of rows in the bucket. Only the innermost bucket is
+	// measured, so selectors on any other bucket can only test count.
+	Metric string
+	// Operator is one of eq, ne, gt, gte, lt or lte.
+	Operator string
+	Value    float64
+}
+
+// validateSelectors ensures each of the bucket's selectors has a known operator,
+// and tests the row count or a metric that is measured on its results.
+func validateSelectors(name string, depth int, query *Query, bucket *Bucket) error {
+	keys := bucketMetricKeys(query, bucket)
+	for _, selector := range bucket.Selectors {
+		switch selector.Operator {
+		case "eq", "ne", "gt", "gte", "lt", "lte":
+		default:
+			return fmt.Errorf("Unknown selector operator: %s", selector.Operator)
+		}
+		if selector.Metric != "count" && !keys[selector.Metric] {
+			return fmt.Errorf("%s selector at depth %d tests metric %s, which isn't measured at that level", name, depth, selector.Metric)
+		}
+	}
+	return nil
+}
+
+// Match determines whether the result bucket satisfies the selector. Buckets
+// without a numerical value for the metric never match.
+func (selector *BucketSelector) Match(result *ResultBucket) (bool, error) {
+	var value float64
+	if selector.Metric == "count" {
+		value = float64(result.rowCount)
+	} else {
+		var ok bool
+		value, ok = metricFloat(result.Metrics[selector.Metric])
+		if !ok {
+			return false, nil
+		}
+	}
+	cmp := 0
+	switch {
+	case value < selector.Value:
+		cmp = -1
+	case value > selector.Value:
+		cmp = 1
+	}
+	return matchOperator(selector.Operator, cmp)
+}
@@ -0,0 +1,181 @@
+package aggro
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// HTMLOptions control how a ResultTable is rendered as HTML. The embedded
+// RenderOptions choose and format the metrics; their Style is ignored.
+type HTMLOptions struct {
+	RenderOptions
+	Classes HTMLClasses
+}
+
+// HTMLClasses are CSS classes added to the elements of an HTML pivot table.
+// Empty classes are left out.
+type HTMLClasses struct {
+	Table       string
+	ColumnTitle string
+	RowTitle    string
+	MetricTitle string
+	Cell        string
+	// Total is added to the titles and cells of a table's margins.
+	Total string
+}
+
+// RenderHTML writes the table to w as an HTML pivot table. Each level of the
+// column titles is a header row, with titles shared by neighbouring columns
+// merged into one cell spanning them, followed by a header row of metrics.
+// Row titles shared by neighbouring rows are likewise merged to span the rows.
+// Totals are rendered if the table was tabulated with margins.
+func RenderHTML(w io.Writer, table *ResultTable, options *HTMLOptions) error {
+	if options == nil {
+		options = &HTMLOptions{}
+	}
+	metrics := options.Metrics
+	if len(metrics) == 0 {
+		cells := []map[string]interface{}{}
+		for _, row := range table.Rows {
+			cells = append(cells, row...)
+		}
+		metrics = metricKeys(cells)
+	}
+	rowDepth := titleDepth(table.RowTitles)
+	columnDepth := titleDepth(table.ColumnTitles)
+	classes := &options.Classes
+	isTotalRow := func(i int) bool {
+		return table.Margins && i == len(table.RowTitles)-1
+	}
+	isTotalColumn := func(j int) bool {
+		return table.Margins && j == len(table.ColumnTitles)-1
+	}
+
+	var out strings.Builder
+	out.WriteString("<table" + classAttribute(classes.Table) + ">\n<thead>\n")
+	for level := 0; level < columnDepth; level++ {
+		out.WriteString("<tr>")
+		if level == 0 && rowDepth > 0 {
+			// The corner above the row titles.
+			out.WriteString("<th" + spanAttribute("rowspan", columnDepth+1) + spanAttribute("colspan", rowDepth) + "></th>")
+		}
+		for j, span := range titleSpans(table.ColumnTitles, level, table.Margins) {
+			if span == 0 {
+				continue
+			}
+			class := classes.ColumnTitle
+			if isTotalColumn(j) {
+				class = joinClasses(class, classes.Total)
+			}
+			out.WriteString("<th" + spanAttribute("colspan", span*len(metrics)) + classAttribute(class) + ">")
+			out.WriteString(html.EscapeString(options.truncate(titleAt(table.ColumnTitles[j], level))) + "</th>")
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("<tr>")
+	if columnDepth == 0 && rowDepth > 0 {
+		out.WriteString("<th" + spanAttribute("colspan", rowDepth) + "></th>")
+	}
+	for j := range table.ColumnTitles {
+		class := classes.MetricTitle
+		if isTotalColumn(j) {
+			class = joinClasses(class, classes.Total)
+		}
+		for _, metric := range metrics {
+			out.WriteString("<th" + classAttribute(class) + ">" + html.EscapeString(metric) + "</th>")
+		}
+	}
+	out.WriteString("</tr>\n</thead>\n<tbody>\n")
+
+	rowSpans := make([][]int, rowDepth)
+	for level := range rowSpans {
+		rowSpans[level] = titleSpans(table.RowTitles, level, table.Margins)
+	}
+	for i, row := range table.Rows {
+		out.WriteString("<tr>")
+		for level := 0; level < rowDepth; level++ {
+			span := rowSpans[level][i]
+			if span == 0 {
+				continue
+			}
+			class := classes.RowTitle
+			if isTotalRow(i) {
+				class = joinClasses(class, classes.Total)
+			}
+			out.WriteString("<th" + spanAttribute("rowspan", span) + classAttribute(class) + ">")
+			out.WriteString(html.EscapeString(options.truncate(titleAt(table.RowTitles[i], level))) + "</th>")
+		}
+		for j, cell := range row {
+			class := classes.Cell
+			if isTotalRow(i) || isTotalColumn(j) {
+				class = joinClasses(class, classes.Total)
+			}
+			for _, metric := range metrics {
+				text, _ := options.format(metric, cell[metric])
+				out.WriteString("<td" + classAttribute(class) + ">" + html.EscapeString(text) + "</td>")
+			}
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("</tbody>\n</table>\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// titleSpans returns, for each title, the number of neighbouring titles that
+// share its parts up to and including the level, if it is the first of them.
+// Titles that follow the first have a span of zero. If the last title is a
+// margin it is never merged, even with a bucket of the same name.
+func titleSpans(titles [][]string, level int, margin bool) []int {
+	spans := make([]int, len(titles))
+	first := 0
+	for i := range titles {
+		isMargin := margin && i == len(titles)-1
+		if i > 0 && !isMargin && sharePrefix(titles[first], titles[i], level) {
+			spans[first]++
+			continue
+		}
+		first = i
+		spans[i] = 1
+	}
+	return spans
+}
+
+// sharePrefix determines whether two titles have the same parts up to and
+// including the level.
+func sharePrefix(a, b []string, level int) bool {
+	for k := 0; k <= level; k++ {
+		if titleAt(a, k) != titleAt(b, k) {
+			return false
+		}
+	}
+	return true
+}
+
+// titleAt returns the part of the title at the level, if it has one.
+func titleAt(title []string, level int) string {
+	if level < len(title) {
+		return title[level]
+	}
+	return ""
+}
+
+func spanAttribute(name string, span int) string {
+	if span <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(` %s="%d"`, name, span)
+}
+
+func classAttribute(class string) string {
+	if class == "" {
+		return ""
+	}
+	return ` class="` + html.EscapeString(class) + `"`
+}
+
+func joinClasses(a, b string) string {
+	return strings.TrimSpace(a + " " + b)
+}
@@ -0,0 +1,116 @@
+package aggro
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRenderHTMLColumnSpans(t *testing.T) {
+	RegisterTestingT(t)
+	_, results := departmentResults(t, []Metric{{Type: "count", Field: "salary"}, {Type: "mean", Field: "salary"}}, &Bucket{
+		Field:           &Field{Name: "start_date", Type: "datetime"},
+		DatetimeOptions: &DatetimeBucketOptions{Period: Year, Location: time.UTC},
+	})
+	table, err := Tabulate(results, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error converting results: %s", err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	err = RenderHTML(buf, table, &HTMLOptions{
+		RenderOptions: RenderOptions{
+			Metrics:       []string{"salary:count", "salary:mean"},
+			NumberFormats: map[string]string{"salary:mean": "%.0f"},
+			Thousands:     true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering HTML: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`<table>
+<thead>
+<tr><th rowspan="3"></th><th colspan="2">Engineering</th><th colspan="2">Marketing</th></tr>
+<tr><th colspan="2">2016-01-01T00:00:00Z</th><th colspan="2">2016-01-01T00:00:00Z</th></tr>
+<tr><th>salary:count</th><th>salary:mean</th><th>salary:count</th><th>salary:mean</th></tr>
+</thead>
+<tbody>
+<tr><th>Auckland</th><td>2</td><td>100,000</td><td>2</td><td>120,000</td></tr>
+<tr><th>Wellington</th><td>3</td><td>133,333</td><td></td><td></td></tr>
+</tbody>
+</table>
+`))
+}
+
+func TestRenderHTMLRowSpansAndTotals(t *testing.T) {
+	RegisterTestingT(t)
+	_, results := departmentResults(t, []Metric{{Type: "count", Field: "salary"}, {Type: "mean", Field: "salary"}}, &Bucket{
+		Field:           &Field{Name: "start_date", Type: "datetime"},
+		DatetimeOptions: &DatetimeBucketOptions{Period: Year, Location: time.UTC},
+	})
+	table, err := TabulateWithOptions(results, 2, &TabulateOptions{Margins: true})
+	if err != nil {
+		t.Fatalf("Unexpected error converting results: %s", err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	err = RenderHTML(buf, table, &HTMLOptions{
+		RenderOptions: RenderOptions{Metrics: []string{"salary:count"}},
+		Classes: HTMLClasses{
+			Table:       "pivot",
+			ColumnTitle: "column",
+			RowTitle:    "row",
+			MetricTitle: "metric",
+			Cell:        "cell",
+			Total:       "total",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering HTML: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`<table class="pivot">
+<thead>
+<tr><th rowspan="2" colspan="2"></th><th class="column">2016-01-01T00:00:00Z</th><th class="column total">Total</th></tr>
+<tr><th class="metric">salary:count</th><th class="metric total">salary:count</th></tr>
+</thead>
+<tbody>
+<tr><th rowspan="2" class="row">Auckland</th><th class="row">Engineering</th><td class="cell">2</td><td class="cell total">2</td></tr>
+<tr><th class="row">Marketing</th><td class="cell">2</td><td class="cell total">2</td></tr>
+<tr><th class="row">Wellington</th><th class="row">Engineering</th><td class="cell">3</td><td class="cell total">3</td></tr>
+<tr><th class="row total">Total</th><th class="row total"></th><td class="cell total">7</td><td class="cell total">7</td></tr>
+</tbody>
+</table>
+`))
+}
+
+func TestRenderHTMLMarginsNotMerged(t *testing.T) {
+	RegisterTestingT(t)
+	// A bucket titled Total beside the margin stays a title of its own.
+	table := &ResultTable{
+		RowTitles:    [][]string{{"Total"}, {MarginTitle}},
+		ColumnTitles: [][]string{{"Total"}, {MarginTitle}},
+		Rows: [][]map[string]interface{}{
+			{{"n": 1.0}, {"n": 1.0}},
+			{{"n": 1.0}, {"n": 1.0}},
+		},
+		Margins: true,
+	}
+	buf := &bytes.Buffer{}
+	err := RenderHTML(buf, table, &HTMLOptions{Classes: HTMLClasses{Total: "total"}})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering HTML: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`<table>
+<thead>
+<tr><th rowspan="2"></th><th>Total</th><th class="total">Total</th></tr>
+<tr><th>n</th><th class="total">n</th></tr>
+</thead>
+<tbody>
+<tr><th>Total</th><td>1</td><td class="total">1</td></tr>
+<tr><th class="total">Total</th><td class="total">1</td><td class="total">1</td></tr>
+</tbody>
+</table>
+`))
+}
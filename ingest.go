@@ -0,0 +1,109 @@
+package aggro
+
+import (
+	"fmt"
+)
+
+// IngestOptions control how Dataset.Ingest handles rows that can't be added.
+type IngestOptions struct {
+	// Mode is either all_or_nothing, where no rows are added if any are
+	// invalid, or skip_invalid, where invalid rows are left out and the rest are
+	// added. Defaults to all_or_nothing.
+	Mode string
+	// MissingAsNil treats a row without a key for one of the Table's fields as
+	// having a nil value for it, rather than being invalid.
+	MissingAsNil bool
+}
+
+// IngestReport describes the outcome of Dataset.Ingest.
+type IngestReport struct {
+	// Added is the number of rows added to the dataset.
+	Added int `json:"added"`
+	// Rejected lists each invalid row, in the order they were given.
+	Rejected []*RejectedRow `json:"rejected"`
+}
+
+// RejectedRow describes a row that couldn't be added to a dataset.
+type RejectedRow struct {
+	// Row is the index of the row within the rows being added.
+	Row int `json:"row"`
+	// Field is the name of the field whose cell was invalid.
+	Field string `json:"field"`
+	// Reason is why the cell was invalid.
+	Reason string `json:"reason"`
+	// cell is the index of the field within the Table's Fields, or -1 for a
+	// derived field.
+	cell int
+}
+
+// Error implements the error interface.
+func (rejected *RejectedRow) Error() string {
+	if rejected.cell < 0 {
+		return fmt.Sprintf("Error adding row %d, derived field %s: %s", rejected.Row, rejected.Field, rejected.Reason)
+	}
+	return fmt.Sprintf("Error adding row %d, cell %d: %s", rejected.Row, rejected.cell, rejected.Reason)
+}
+
+// Ingest adds rows to the dataset like AddRows, reporting each row that is
+// invalid rather than only the first. In all_or_nothing mode no rows are added
+// if any are rejected, and an error is returned along with the report. In
+// skip_invalid mode the valid rows are added regardless.
+func (set *Dataset) Ingest(options *IngestOptions, rows ...map[string]interface{}) (*IngestReport, error) {
+	next := 0
+	return set.ingest(options, func() (map[string]interface{}, bool, error) {
+		if next == len(rows) {
+			return nil, false, nil
+		}
+		next++
+		return rows[next-1], true, nil
+	})
+}
+
+// ingest adds the rows returned by next until it returns false, as described
+// by Ingest. If next returns an error, no rows are added and it is returned, so
+// the valid rows are held until next is done, in either mode.
+func (set *Dataset) ingest(options *IngestOptions, next func() (map[string]interface{}, bool, error)) (*IngestReport, error) {
+	if options == nil {
+		options = &IngestOptions{}
+	}
+	switch options.Mode {
+	case "", "all_or_nothing", "skip_invalid":
+	default:
+		return nil, fmt.Errorf("Unknown ingest mode: %s", options.Mode)
+	}
+	expressions, err := set.Table.expressions()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IngestReport{Rejected: []*RejectedRow{}}
+	valid := []map[string]Cell{}
+	count := 0
+	for ; ; count++ {
+		data, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		row, rejected := set.newRow(count, data, expressions, options.MissingAsNil)
+		if rejected != nil {
+			report.Rejected = append(report.Rejected, rejected)
+			continue
+		}
+		valid = append(valid, row)
+	}
+	if len(report.Rejected) > 0 && options.Mode != "skip_invalid" {
+		return report, fmt.Errorf("Rejected %d of %d rows, so none were added", len(report.Rejected), count)
+	}
+
+	for _, row := range valid {
+		set.store(row)
+	}
+	report.Added = len(valid)
+	for _, live := range set.live {
+		live.add(valid)
+	}
+	return report, nil
+}
@@ -0,0 +1,79 @@
+package aggro
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// LoadJSONLines adds rows to the dataset from newline delimited JSON (NDJSON),
+// with a JSON object per row. Rows are decoded one at a time as they are read
+// from r, and added as described by Ingest. Numbers are decoded as json.Number
+// so that they keep their exact decimal values, and nested objects can be read
+// with dotted field names. If the JSON is invalid, no rows are added.
+//
+// The decoded rows' cells are held until the whole input has been read, so
+// that none are added if a later row is invalid or the JSON is malformed. Only
+// the JSON text of one row is held at a time.
+func (set *Dataset) LoadJSONLines(r io.Reader, options *IngestOptions) (*IngestReport, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	row := 0
+	return set.ingest(options, func() (map[string]interface{}, bool, error) {
+		data := map[string]interface{}{}
+		if err := decoder.Decode(&data); err != nil {
+			if err == io.EOF {
+				return nil, false, nil
+			}
+			return nil, false, jsonRowError(row, err)
+		}
+		row++
+		return data, true, nil
+	})
+}
+
+// LoadJSONArray adds rows to the dataset from a JSON array of objects, with an
+// object per row. Rows are decoded one at a time as they are read from r, and
+// added as described by LoadJSONLines. Nothing but whitespace may follow the
+// array.
+func (set *Dataset) LoadJSONArray(r io.Reader, options *IngestOptions) (*IngestReport, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSON array: %s", err.Error())
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("Invalid JSON array: expected [, got %v", token)
+	}
+	row := 0
+	return set.ingest(options, func() (map[string]interface{}, bool, error) {
+		if !decoder.More() {
+			// Consume the closing bracket, which also checks that it's there.
+			if _, err := decoder.Token(); err != nil {
+				return nil, false, fmt.Errorf("Invalid JSON array: %s", err.Error())
+			}
+			if token, err := decoder.Token(); err != io.EOF {
+				if err == nil {
+					err = fmt.Errorf("unexpected %v after ]", token)
+				}
+				return nil, false, fmt.Errorf("Invalid JSON array: %s", err.Error())
+			}
+			return nil, false, nil
+		}
+		data := map[string]interface{}{}
+		if err := decoder.Decode(&data); err != nil {
+			return nil, false, jsonRowError(row, err)
+		}
+		row++
+		return data, true, nil
+	})
+}
+
+// jsonRowError describes an error decoding the row at index.
+func jsonRowError(row int, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Invalid JSON at row %d: %s", row, err.Error())
+}
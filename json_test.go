@@ -0,0 +1,85 @@
+package aggro
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/shopspring/decimal"
+)
+
+var jsonTable = &Table{
+	Fields: []Field{
+		{"id", "number"},
+		{"team.name", "string"},
+		{"tags", "[]string"},
+		{"active", "boolean"},
+	},
+}
+
+func TestLoadJSONLines(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{Table: jsonTable}
+	report, err := dataset.LoadJSONLines(strings.NewReader(`
+{"id": 9007199254740993, "team": {"name": "core"}, "tags": ["go"], "active": true}
+{"id": 12345678901234567890.5, "team": null, "tags": [], "active": false}
+
+{"id": "oops", "team": {"name": "core"}, "tags": ["go"], "active": true}
+`), &IngestOptions{Mode: "skip_invalid"})
+	if err != nil {
+		t.Fatalf("Unexpected error loading JSON lines: %s", err.Error())
+	}
+	Expect(report.Added).To(Equal(2))
+	Expect(report.Rejected).To(Equal([]*RejectedRow{
+		{Row: 2, Field: "id", Reason: "Expected number, got string", cell: 0},
+	}))
+
+	// Large numbers keep their exact values.
+	Expect(dataset.Rows[0]["id"].MeasurableCell().Value()).To(Equal(decimalPointer("9007199254740993")))
+	Expect(dataset.Rows[1]["id"].MeasurableCell().Value()).To(Equal(decimalPointer("12345678901234567890.5")))
+	Expect(dataset.Rows[0]["team.name"].MeasurableCell().Value()).To(Equal("core"))
+	Expect(dataset.Rows[1]).NotTo(HaveKey("team.name"))
+
+	// Invalid JSON adds no rows.
+	_, err = dataset.LoadJSONLines(strings.NewReader(`{"id": 1, "team": null, "tags": [], "active": true}
+{"id": 2,`), nil)
+	Expect(err).To(MatchError("Invalid JSON at row 1: unexpected EOF"))
+	Expect(dataset.Rows).To(HaveLen(2))
+}
+
+func TestLoadJSONArray(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{Table: jsonTable}
+	report, err := dataset.LoadJSONArray(strings.NewReader(`[
+		{"id": 1, "team": {"name": "core"}, "tags": ["go", "rust"], "active": true},
+		{"id": 2, "team": {"name": "web"}, "tags": ["js"], "active": false}
+	]`), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error loading JSON array: %s", err.Error())
+	}
+	Expect(report.Added).To(Equal(2))
+	Expect(dataset.Rows[1]["tags"].MeasurableCell().Value()).To(Equal([]interface{}{"js"}))
+
+	_, err = dataset.LoadJSONArray(strings.NewReader(`{"id": 1}`), nil)
+	Expect(err).To(MatchError("Invalid JSON array: expected [, got {"))
+	_, err = dataset.LoadJSONArray(strings.NewReader(`[{"id": 1, "team": null, "tags": [], "active": true}`), nil)
+	Expect(err).To(MatchError("Invalid JSON at row 1: unexpected end of JSON input"))
+	_, err = dataset.LoadJSONArray(strings.NewReader(`[{"id": 1}, 2]`), &IngestOptions{MissingAsNil: true})
+	Expect(err).To(MatchError("Invalid JSON at row 1: json: cannot unmarshal number into Go value of type map[string]interface {}"))
+	_, err = dataset.LoadJSONArray(strings.NewReader(`[{"id": 3, "team": null, "tags": [], "active": true}] [`), nil)
+	Expect(err).To(MatchError("Invalid JSON array: unexpected [ after ]"))
+	_, err = dataset.LoadJSONArray(strings.NewReader(`[{"id": 3, "team": null, "tags": [], "active": true}] x`), nil)
+	Expect(err).To(MatchError(ContainSubstring("Invalid JSON array: invalid character 'x'")))
+	Expect(dataset.Rows).To(HaveLen(2))
+
+	// All or nothing applies across the whole array.
+	report, err = dataset.LoadJSONArray(strings.NewReader(`[{"id": 3, "team": null, "tags": [], "active": true}, {"id": 4}]`), nil)
+	Expect(err).To(MatchError("Rejected 1 of 2 rows, so none were added"))
+	Expect(report.Rejected).To(HaveLen(1))
+	Expect(dataset.Rows).To(HaveLen(2))
+}
+
+func decimalPointer(value string) *decimal.Decimal {
+	d := decimal.RequireFromString(value)
+	return &d
+}
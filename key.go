@@ -0,0 +1,118 @@
+package aggro
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// bucketKeyString returns the string form of a bucket key, which buckets are
+// looked up by and which is the bucket's Value. Datetimes are RFC3339 strings
+// and numbers are their exact decimal strings. The nil key of the missing
+// bucket is missingBucketKey.
+func bucketKeyString(key interface{}) string {
+	switch k := key.(type) {
+	case nil:
+		return missingBucketKey
+	case string:
+		return k
+	case time.Time:
+		return k.Format(time.RFC3339)
+	case decimal.Decimal:
+		return k.String()
+	case bool:
+		if k {
+			return "true"
+		}
+		return "false"
+	}
+	return fmt.Sprint(key)
+}
+
+// parseBucketKey returns the typed key of a bucket of the aggregate from its
+// string Value, as produced by bucketKeyString. Values that can't be parsed
+// are kept as strings.
+func parseBucketKey(aggregate *Bucket, value string) interface{} {
+	if value == missingBucketKey {
+		return nil
+	}
+	if aggregate == nil || aggregate.Field == nil || aggregate.FilterOptions != nil || aggregate.FiltersOptions != nil {
+		return value
+	}
+	switch elementType(aggregate.Field.Type) {
+	case fieldTypeDatetime:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			if aggregate.DatetimeOptions != nil && aggregate.DatetimeOptions.Location != nil {
+				t = t.In(aggregate.DatetimeOptions.Location)
+			}
+			return t
+		}
+	case fieldTypeNumber:
+		if d, err := decimal.NewFromString(value); err == nil {
+			return d
+		}
+	case fieldTypeBoolean:
+		switch value {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+	}
+	return value
+}
+
+// compareKeys compares two bucket keys, returning -1, 0 or 1. Datetimes compare
+// chronologically, numbers numerically and false comes before true. Strings
+// that hold numbers compare numerically, and any other keys compare by their
+// strings.
+func compareKeys(a, b interface{}) int {
+	switch x := a.(type) {
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	case decimal.Decimal:
+		if y, ok := numericKey(b); ok {
+			return x.Cmp(y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case y:
+				return -1
+			}
+			return 1
+		}
+	case string:
+		if x1, ok := numericKey(x); ok {
+			if y, ok := numericKey(b); ok {
+				return x1.Cmp(y)
+			}
+		}
+	}
+	return strings.Compare(bucketKeyString(a), bucketKeyString(b))
+}
+
+// numericKey returns the key as a decimal if it is, or is a string of, a
+// number.
+func numericKey(key interface{}) (decimal.Decimal, bool) {
+	switch k := key.(type) {
+	case decimal.Decimal:
+		return k, true
+	case string:
+		d, err := decimal.NewFromString(k)
+		return d, err == nil
+	}
+	return decimal.Decimal{}, false
+}
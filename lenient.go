@@ -0,0 +1,123 @@
+package aggro
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// LenientOptions make queries skip rows and cells that can't be aggregated or
+// measured, rather than failing. A RowError is recorded in the Resultset's
+// Errors for each one skipped.
+//
+// Only errors caused by a row's data are skipped. Errors in the query itself,
+// such as an unknown datetime period, invalid range values or a filter value
+// that can't be compared with its field, apply to every row and still fail the
+// query.
+type LenientOptions struct {
+	// MaxErrors is the number of row errors kept. Further errors are still
+	// skipped, but aren't recorded. Defaults to 100.
+	MaxErrors int
+}
+
+// RowError describes a row, or a cell of a row, that a lenient query skipped.
+type RowError struct {
+	// Row is the index of the row within the dataset, or -1 if the error
+	// applies to every row, such as a metric that can't measure the field.
+	Row int `json:"row"`
+	// Field is the name of the field whose cell caused the error.
+	Field string `json:"field"`
+	// Metric is the key of the metric being measured, e.g. salary:mean, if the
+	// error happened while measuring.
+	Metric string `json:"metric,omitempty"`
+	// Reason is why the row or cell was skipped.
+	Reason string `json:"reason"`
+}
+
+// Error implements the error interface.
+func (err *RowError) Error() string {
+	if err.Row < 0 {
+		return fmt.Sprintf("Metric %s skipped: %s", err.Metric, err.Reason)
+	}
+	if err.Metric != "" {
+		return fmt.Sprintf("Row %d skipped for metric %s: %s", err.Row, err.Metric, err.Reason)
+	}
+	return fmt.Sprintf("Row %d skipped at field %s: %s", err.Row, err.Field, err.Reason)
+}
+
+// rowErrors collects the errors of a lenient query, up to a maximum. It is
+// safe for concurrent use.
+type rowErrors struct {
+	mutex  sync.Mutex
+	max    int
+	errors []*RowError
+	// metrics records the metrics with an error for every row, which are only
+	// reported once however many buckets they are measured in.
+	metrics map[string]bool
+}
+
+func newRowErrors(options *LenientOptions) *rowErrors {
+	max := options.MaxErrors
+	if max <= 0 {
+		max = 100
+	}
+	return &rowErrors{max: max, metrics: map[string]bool{}}
+}
+
+// add records the error, unless the maximum has been reached.
+func (errs *rowErrors) add(err *RowError) {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	if len(errs.errors) < errs.max {
+		errs.errors = append(errs.errors, err)
+	}
+}
+
+// addMetric records an error that applies to every row measured by the
+// metric, unless it has already been recorded.
+func (errs *rowErrors) addMetric(field, metric, reason string) {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	if errs.metrics[metric] {
+		return
+	}
+	errs.metrics[metric] = true
+	if len(errs.errors) < errs.max {
+		errs.errors = append(errs.errors, &RowError{Row: -1, Field: field, Metric: metric, Reason: reason})
+	}
+}
+
+// sorted returns the recorded errors in row order, as workers may record them
+// in any order.
+func (errs *rowErrors) sorted() []*RowError {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	sorted := append([]*RowError{}, errs.errors...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Row < sorted[j].Row
+	})
+	return sorted
+}
+
+// list returns the recorded errors in row order, or nil if there are none.
+func (errs *rowErrors) list() []error {
+	sorted := errs.sorted()
+	if len(sorted) == 0 {
+		return nil
+	}
+	list := make([]error, len(sorted))
+	for i, err := range sorted {
+		list[i] = err
+	}
+	return list
+}
+
+// rowError fails the query with err or, if the query is lenient, records it
+// against the row so that the query can carry on without it.
+func (p *queryProcessor) rowError(index int, field, metric string, err error) {
+	if p.rowErrors == nil {
+		p.err = err
+		return
+	}
+	p.rowErrors.add(&RowError{Row: index, Field: field, Metric: metric, Reason: err.Error()})
+}
@@ -0,0 +1,101 @@
+package aggro
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Limits guard against queries that would create enough result buckets to
+// exhaust memory, such as nested buckets on high cardinality fields or datetime
+// gap filling across a long span. Zero values are unlimited.
+type Limits struct {
+	// MaxBuckets is the total number of result buckets a query may create.
+	// Parallel queries count the buckets created by each worker before they
+	// are merged, as they are all held in memory at once.
+	MaxBuckets int
+	// MaxBucketsPerLevel is the number of result buckets that may share a
+	// parent, or sit at the root of the results.
+	MaxBucketsPerLevel int
+	// MaxGapFill is the number of periods a datetime bucket may be gap filled
+	// across, from its first to its last period.
+	MaxGapFill int
+}
+
+// LimitError is returned when running a query exceeds one of the dataset's
+// Limits. It describes the bucket that was being created at the time.
+type LimitError struct {
+	// Limit is the name of the limit that was exceeded, e.g. MaxBuckets.
+	Limit string
+	// Max is the value of the limit that was exceeded.
+	Max int
+	// Field is the name of the bucket's field, or the bucket type if the bucket
+	// isn't on a field.
+	Field string
+	// Value is the value of the bucket that exceeded the limit.
+	Value string
+}
+
+// Error implements the error interface.
+func (err *LimitError) Error() string {
+	if err.Value == "" {
+		return fmt.Sprintf("Query exceeded %s limit of %d at bucket %s", err.Limit, err.Max, err.Field)
+	}
+	return fmt.Sprintf("Query exceeded %s limit of %d creating bucket %s=%s", err.Limit, err.Max, err.Field, err.Value)
+}
+
+// bucketName describes the bucket definition for errors.
+func bucketName(bucket *Bucket) string {
+	switch {
+	case bucket == nil:
+		return ""
+	case bucket.Field != nil:
+		return bucket.Field.Name
+	case bucket.FilterOptions != nil:
+		return "filter"
+	case bucket.FiltersOptions != nil:
+		return "filters"
+	}
+	return ""
+}
+
+// addBucket records that a result bucket is about to be created for the value
+// within results, returning false and setting the processor error if this
+// exceeds the dataset's limits. Existing buckets are always allowed.
+func (p *queryProcessor) addBucket(bucket *Bucket, results map[string]*ResultBucket, value string) bool {
+	if _, ok := results[value]; ok {
+		return true
+	}
+	p.bucketCount++
+	limits := p.dataset.Limits
+	if limits == nil {
+		return true
+	}
+	count := p.bucketCount
+	if p.created != nil {
+		count = int(atomic.AddInt64(p.created, 1))
+	}
+	// The missing bucket has no value to report.
+	if value == missingBucketKey {
+		value = ""
+	}
+	if limits.MaxBuckets > 0 && count > limits.MaxBuckets {
+		p.err = &LimitError{"MaxBuckets", limits.MaxBuckets, bucketName(bucket), value}
+		return false
+	}
+	if limits.MaxBucketsPerLevel > 0 && len(results) >= limits.MaxBucketsPerLevel {
+		p.err = &LimitError{"MaxBucketsPerLevel", limits.MaxBucketsPerLevel, bucketName(bucket), value}
+		return false
+	}
+	return true
+}
+
+// checkGapFill returns false and sets the processor error if gap filling the
+// bucket to a number of periods exceeds the dataset's limits.
+func (p *queryProcessor) checkGapFill(bucket *Bucket, periods int, value string) bool {
+	limits := p.dataset.Limits
+	if limits == nil || limits.MaxGapFill <= 0 || periods <= limits.MaxGapFill {
+		return true
+	}
+	p.err = &LimitError{"MaxGapFill", limits.MaxGapFill, bucketName(bucket), value}
+	return false
+}
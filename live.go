@@ -0,0 +1,194 @@
+package aggro
+
+import (
+	"context"
+	"sync"
+)
+
+// LiveQuery is a query whose results are kept up to date as rows are added to
+// its Dataset with AddRows. Rows are aggregated and measured as they arrive, so
+// the latest results are available without re-processing every row. A
+// LiveQuery is safe to read from while rows are being added, but creating and
+// closing live queries must not happen concurrently with AddRows.
+type LiveQuery struct {
+	mutex     sync.Mutex
+	dataset   *Dataset
+	processor *queryProcessor
+	tree      *Resultset
+	measurers map[*ResultBucket]*liveMeasurers
+	// rows holds the live query's own reference to each row, so that they can
+	// be read while more are added to the dataset.
+	rows *liveRows
+}
+
+// liveRows is the rowSource of a live query: the dataset's rows when the query
+// was created, read from a view of its Columns if it has them, followed by the
+// rows added since.
+type liveRows struct {
+	columns *Columns
+	rows    rowSlice
+}
+
+func (rows *liveRows) length() int {
+	if rows.columns == nil {
+		return len(rows.rows)
+	}
+	return rows.columns.Len() + len(rows.rows)
+}
+
+// field returns a reader that sees rows added after it was created.
+func (rows *liveRows) field(name string) fieldReader {
+	if rows.columns == nil {
+		return func(index int) (interface{}, interface{}) {
+			return cellValue(rows.rows[index][name])
+		}
+	}
+	column := rows.columns.field(name)
+	return func(index int) (interface{}, interface{}) {
+		if index < rows.columns.Len() {
+			return column(index)
+		}
+		return cellValue(rows.rows[index-rows.columns.Len()][name])
+	}
+}
+
+// snapshot returns a copy of the rows that isn't changed as more are added.
+func (rows *liveRows) snapshot() *liveRows {
+	return &liveRows{columns: rows.columns, rows: rows.rows[:len(rows.rows):len(rows.rows)]}
+}
+
+// liveMeasurers holds the measurers of a tip bucket, and how many of the
+// bucket's rows they have been given.
+type liveMeasurers struct {
+	measurers []measurer
+	measured  int
+}
+
+// Live creates a LiveQuery for the query, aggregating the dataset's existing
+// rows straight away.
+func (set *Dataset) Live(query *Query) (*LiveQuery, error) {
+	p := &queryProcessor{
+		ctx:     context.Background(),
+		dataset: set,
+		query:   query,
+	}
+	live := &LiveQuery{
+		dataset:   set,
+		processor: p,
+		measurers: map[*ResultBucket]*liveMeasurers{},
+		rows:      &liveRows{},
+	}
+	if set.Columns != nil {
+		live.rows.columns = set.Columns.view()
+	} else {
+		// Cap the slice so that appending to it never writes to the dataset's.
+		live.rows.rows = rowSlice(set.Rows[:len(set.Rows):len(set.Rows)])
+	}
+	p.source = live.rows
+	p.prepare()
+	if p.err = validateQuery("Query", query); p.err != nil {
+		return nil, p.err
+	}
+	if p.err = p.prepareBuckets(query); p.err != nil {
+		return nil, p.err
+	}
+	live.tree = p.aggregateRows(0, live.rows.length(), nil)
+	if p.err != nil {
+		return nil, p.err
+	}
+	set.live = append(set.live, live)
+	return live, nil
+}
+
+// add aggregates rows that have been appended to the dataset.
+func (live *LiveQuery) add(rows []map[string]Cell) {
+	live.mutex.Lock()
+	defer live.mutex.Unlock()
+	if live.processor.err != nil {
+		return
+	}
+	start := live.rows.length()
+	live.rows.rows = append(live.rows.rows, rows...)
+	live.tree = live.processor.aggregateRows(start, live.rows.length(), live.tree)
+}
+
+// Results returns the query's results for every row added so far. Each call
+// returns a new Resultset, which isn't modified as further rows are added. Once
+// an error has occurred, it is returned by every call.
+func (live *LiveQuery) Results() (*Resultset, error) {
+	live.mutex.Lock()
+	defer live.mutex.Unlock()
+
+	p := live.processor
+	p.fillDatetimeGaps(p.query, live.tree)
+	p.fillRangeGaps(p.query, live.tree)
+	live.measure()
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	// Selecting, sorting and pipelines modify the results, so work on a copy.
+	results := cloneResultset(live.tree)
+	results.Composition = p.composition[:len(p.composition):len(p.composition)]
+	// The results read the rows for margins, so give them rows that aren't
+	// appended to by later calls to AddRows.
+	(&queryProcessor{source: live.rows.snapshot()}).attach(p.query, results)
+	if p.rowErrors != nil {
+		results.Errors = p.rowErrors.list()
+	}
+	if err := selectResultset(p.query, results); err != nil {
+		return nil, err
+	}
+	sortResultset(p.ctx, p.query, results)
+	if err := pipelineResultset(p.query, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// measure adds any new rows in each tip bucket to its measurers, updating the
+// bucket's metrics.
+func (live *LiveQuery) measure() {
+	p := live.processor
+	if p.err != nil {
+		return
+	}
+	scripts := p.parseScripts()
+	if p.err != nil {
+		return
+	}
+	for bucket, query := range p.tipBuckets {
+		state := live.measurers[bucket]
+		if state == nil {
+			measurers, err := newMeasurers(query.Metrics)
+			if err != nil {
+				p.err = err
+				return
+			}
+			state = &liveMeasurers{measurers: measurers}
+			live.measurers[bucket] = state
+		} else if state.measured == len(bucket.sourceRows) {
+			// Nothing has changed since the bucket was last measured.
+			continue
+		}
+		p.err = p.addMeasurerRows(query.Metrics, state.measurers, bucket.sourceRows[state.measured:])
+		if p.err != nil {
+			return
+		}
+		state.measured = len(bucket.sourceRows)
+		p.err = setBucketMetrics(bucket, query, state.measurers, scripts[query])
+		if p.err != nil {
+			return
+		}
+	}
+}
+
+// Close stops the live query from being updated as rows are added.
+func (live *LiveQuery) Close() {
+	for i, other := range live.dataset.live {
+		if other == live {
+			live.dataset.live = append(live.dataset.live[:i], live.dataset.live[i+1:]...)
+			return
+		}
+	}
+}
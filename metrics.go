@@ -34,14 +34,92 @@ func (m *Metric) measurer() (measurer, error) {
 		return &stdev{}, nil
 	case "count":
 		return &valueCount{}, nil
+	case "true_count", "false_count", "true_ratio":
+		return &booleanCount{result: m.Type}, nil
 	default:
 		return nil, fmt.Errorf("Unknown metric: %s", m.Type)
 	}
 }
 
+// BucketScript computes a metric from the other metrics of each tip bucket with
+// an expression, e.g. `salary:sum / salary:count`. Metrics are referred to by
+// their key, and `count` is the number of rows in the bucket. The result is
+// stored in the bucket's Metrics under Name, where it can be sorted on and
+// referred to by later scripts. See expression.go for the expression syntax.
+type BucketScript struct {
+	Name   string
+	Script string
+}
+
+// parseBucketScripts parses the expression of each script.
+func parseBucketScripts(scripts []BucketScript) ([]expression, error) {
+	expressions := make([]expression, len(scripts))
+	for i, script := range scripts {
+		expr, err := parseExpression(script.Script)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bucket script %s: %s", script.Name, err.Error())
+		}
+		expressions[i] = expr
+	}
+	return expressions, nil
+}
+
+// runBucketScripts evaluates the parsed scripts against the bucket's metrics,
+// storing each result in the bucket's metrics.
+func runBucketScripts(scripts []BucketScript, expressions []expression, bucket *ResultBucket) error {
+	scope := func(name string) (interface{}, error) {
+		value, ok := bucket.Metrics[name]
+		if !ok {
+			if name == "count" {
+				return decimal.New(int64(bucket.rowCount), 0), nil
+			}
+			return nil, fmt.Errorf("Unknown metric %s", name)
+		}
+		if value == nil {
+			return nil, nil
+		}
+		f, ok := metricFloat(value)
+		if !ok {
+			return nil, fmt.Errorf("Metric %s is not numerical", name)
+		}
+		return decimal.NewFromFloat(f), nil
+	}
+	for i, expr := range expressions {
+		value, err := expr.eval(scope)
+		if err != nil {
+			return fmt.Errorf("Error running bucket script %s: %s", scripts[i].Name, err.Error())
+		}
+		// Numbers are returned as float64 to match the measured metrics.
+		if d, ok := value.(decimal.Decimal); ok {
+			value, _ = d.Float64()
+		}
+		bucket.Metrics[scripts[i].Name] = value
+	}
+	return nil
+}
+
 type measurer interface {
 	AddDatum(interface{})
 	Result() interface{}
+	// State returns the measurer's intermediate state, which can be merged
+	// into another measurer of the same type.
+	State() *MeasurerState
+	// Merge combines the state of another measurer of the same type into this
+	// measurer, as though it had been given the other measurer's data.
+	Merge(*MeasurerState)
+}
+
+// MeasurerState is the intermediate state of a measurer, before its result is
+// calculated. Each measurer only uses the fields it needs. Decimals are encoded
+// as strings so that no precision is lost.
+type MeasurerState struct {
+	Count    int               `json:"count,omitempty"`
+	Sum      *decimal.Decimal  `json:"sum,omitempty"`
+	Value    *decimal.Decimal  `json:"value,omitempty"`
+	Values   []decimal.Decimal `json:"values,omitempty"`
+	Distinct map[string]int    `json:"distinct,omitempty"`
+	// SumSquares is the sum of the squares of the values.
+	SumSquares *decimal.Decimal `json:"sum_squares,omitempty"`
 }
 
 // Mean
@@ -62,6 +140,18 @@ func (a *mean) AddDatum(datum interface{}) {
 	a.sum = a.sum.Add(*amount)
 }
 
+func (a *mean) State() *MeasurerState {
+	sum := a.sum
+	return &MeasurerState{Count: a.count, Sum: &sum}
+}
+
+func (a *mean) Merge(state *MeasurerState) {
+	a.count += state.Count
+	if state.Sum != nil {
+		a.sum = a.sum.Add(*state.Sum)
+	}
+}
+
 func (a *mean) Result() interface{} {
 	if a.count == 0 {
 		return nil
@@ -88,6 +178,14 @@ func (a *median) AddDatum(datum interface{}) {
 	a.list = append(a.list, *amount)
 }
 
+func (a *median) State() *MeasurerState {
+	return &MeasurerState{Values: a.list}
+}
+
+func (a *median) Merge(state *MeasurerState) {
+	a.list = append(a.list, state.Values...)
+}
+
 func (a *median) Result() interface{} {
 	if len(a.list) == 0 {
 		return nil
@@ -141,6 +239,15 @@ func (a *mode) AddDatum(datum interface{}) {
 	a.count++
 }
 
+func (a *mode) State() *MeasurerState {
+	return &MeasurerState{Values: a.list}
+}
+
+func (a *mode) Merge(state *MeasurerState) {
+	a.list = append(a.list, state.Values...)
+	a.count += len(state.Values)
+}
+
 func (a *mode) Result() interface{} {
 	if len(a.list) == 0 {
 		return nil
@@ -199,6 +306,16 @@ func (a *min) AddDatum(datum interface{}) {
 	}
 }
 
+func (a *min) State() *MeasurerState {
+	return &MeasurerState{Value: a.amount}
+}
+
+func (a *min) Merge(state *MeasurerState) {
+	if state.Value != nil {
+		a.AddDatum(state.Value)
+	}
+}
+
 func (a *min) Result() interface{} {
 	if a.amount == nil {
 		return nil
@@ -226,6 +343,16 @@ func (a *max) AddDatum(datum interface{}) {
 	}
 }
 
+func (a *max) State() *MeasurerState {
+	return &MeasurerState{Value: a.amount}
+}
+
+func (a *max) Merge(state *MeasurerState) {
+	if state.Value != nil {
+		a.AddDatum(state.Value)
+	}
+}
+
 func (a *max) Result() interface{} {
 	if a.amount == nil {
 		return nil
@@ -237,24 +364,37 @@ func (a *max) Result() interface{} {
 // Cardinality
 // Cardinality is a count of unique values in our dataset.
 type cardinality struct {
-	values map[interface{}]int
+	values map[string]int
 }
 
 func (a *cardinality) AddDatum(datum interface{}) {
 	if a.values == nil {
-		a.values = map[interface{}]int{}
+		a.values = map[string]int{}
 	}
 
-	// Track frequency of our values within the dataset.
+	// Track frequency of our values within the dataset. A field only holds one
+	// type of value, so numbers are keyed by their canonical decimal string.
 	switch t := datum.(type) {
 	case *decimal.Decimal:
-		floatVal, _ := t.Float64()
-		a.values[floatVal]++
+		a.values[t.String()]++
 	case string:
 		a.values[t]++
 	}
 }
 
+func (a *cardinality) State() *MeasurerState {
+	return &MeasurerState{Distinct: a.values}
+}
+
+func (a *cardinality) Merge(state *MeasurerState) {
+	if a.values == nil {
+		a.values = map[string]int{}
+	}
+	for value, count := range state.Distinct {
+		a.values[value] += count
+	}
+}
+
 func (a *cardinality) Result() interface{} {
 	return len(a.values)
 }
@@ -269,10 +409,58 @@ func (a *valueCount) AddDatum(datum interface{}) {
 	a.size++
 }
 
+func (a *valueCount) State() *MeasurerState {
+	return &MeasurerState{Count: a.size}
+}
+
+func (a *valueCount) Merge(state *MeasurerState) {
+	a.size += state.Count
+}
+
 func (a *valueCount) Result() interface{} {
 	return a.size
 }
 
+// Boolean Count
+// booleanCount counts the true and false values in the dataset. Its result is
+// the number of true values, the number of false values or the ratio of true
+// values to all values, depending on the metric type.
+type booleanCount struct {
+	result string
+	trues  int
+	falses int
+}
+
+func (a *booleanCount) AddDatum(datum interface{}) {
+	if datum.(bool) {
+		a.trues++
+	} else {
+		a.falses++
+	}
+}
+
+func (a *booleanCount) State() *MeasurerState {
+	return &MeasurerState{Distinct: map[string]int{"true": a.trues, "false": a.falses}}
+}
+
+func (a *booleanCount) Merge(state *MeasurerState) {
+	a.trues += state.Distinct["true"]
+	a.falses += state.Distinct["false"]
+}
+
+func (a *booleanCount) Result() interface{} {
+	switch a.result {
+	case "true_count":
+		return a.trues
+	case "false_count":
+		return a.falses
+	}
+	if a.trues+a.falses == 0 {
+		return nil
+	}
+	return float64(a.trues) / float64(a.trues+a.falses)
+}
+
 // Sum
 // Sum is all dataset values added together.
 type sum struct {
@@ -286,6 +474,17 @@ func (a *sum) AddDatum(datum interface{}) {
 	a.sum = a.sum.Add(*amount)
 }
 
+func (a *sum) State() *MeasurerState {
+	sum := a.sum
+	return &MeasurerState{Sum: &sum}
+}
+
+func (a *sum) Merge(state *MeasurerState) {
+	if state.Sum != nil {
+		a.sum = a.sum.Add(*state.Sum)
+	}
+}
+
 func (a *sum) Result() interface{} {
 	result, _ := a.sum.Float64()
 	return result
@@ -296,14 +495,13 @@ func (a *sum) Result() interface{} {
 // It's calculated as square root of 'variance'. Variance is the average of the
 // squared differences from the mean.
 //
-// 1) Determine mean.
-// 2) Then for each value in the dataset, subtract the mean and square the result.
-// 3) Calculate the mean of those squared differences (variance).
-// 4) Return square root of variance.
+// Rather than keeping every value, the count, sum and sum of squares are kept,
+// from which the sum of squared differences from the mean is calculated as
+// sum of squares - sum^2 / count. They're decimals, so this loses no precision.
 type stdev struct {
-	count int
-	sum   decimal.Decimal
-	list  []decimal.Decimal
+	count      int
+	sum        decimal.Decimal
+	sumSquares decimal.Decimal
 }
 
 func (a *stdev) AddDatum(datum interface{}) {
@@ -313,11 +511,24 @@ func (a *stdev) AddDatum(datum interface{}) {
 	// Increase our count.
 	a.count++
 
-	// Add our value to existing sum.
+	// Add our value, and its square, to the existing sums.
 	a.sum = a.sum.Add(*amount)
+	a.sumSquares = a.sumSquares.Add(amount.Mul(*amount))
+}
 
-	// Append value to stdev slice.
-	a.list = append(a.list, *amount)
+func (a *stdev) State() *MeasurerState {
+	sum, sumSquares := a.sum, a.sumSquares
+	return &MeasurerState{Count: a.count, Sum: &sum, SumSquares: &sumSquares}
+}
+
+func (a *stdev) Merge(state *MeasurerState) {
+	a.count += state.Count
+	if state.Sum != nil {
+		a.sum = a.sum.Add(*state.Sum)
+	}
+	if state.SumSquares != nil {
+		a.sumSquares = a.sumSquares.Add(*state.SumSquares)
+	}
 }
 
 func (a *stdev) Result() interface{} {
@@ -326,20 +537,15 @@ func (a *stdev) Result() interface{} {
 		return nil
 	}
 
-	// 1) Determine the mean (avg).
-	mean, _ := a.sum.Div(decimal.NewFromFloat(float64(a.count))).Float64()
-
-	// 2) Ranging our dataset, subtract mean from value and square the result.
-	total := 0.0
-	for _, number := range a.list {
-		val, _ := number.Float64()
-		total += math.Pow(val-mean, 2)
-	}
+	// 1) Sum the squared differences from the mean, as
+	// (count * sum of squares - sum^2) / count to keep it exact.
+	count := decimal.New(int64(a.count), 0)
+	total := count.Mul(a.sumSquares).Sub(a.sum.Mul(a.sum))
 
-	// 3) Calculate the variance (mean of our squared results).
-	variance := total / float64(len(a.list)-1)
+	// 2) Calculate the variance (mean of the squared differences).
+	variance, _ := total.Div(count.Mul(count.Sub(decimal.New(1, 0)))).Float64()
 
-	// 4) Square the result.
+	// 3) Square root the result.
 	return math.Sqrt(variance)
 }
 
@@ -0,0 +1,171 @@
+package aggro
+
+import (
+	"fmt"
+	"sync"
+)
+
+// aggregateParallel splits the rows into a chunk per worker and aggregates each
+// chunk into its own partial results concurrently. The partial results are then
+// merged in chunk order, so the rows in each bucket keep their dataset order.
+func (p *queryProcessor) aggregateParallel(workers int) *Resultset {
+	length := p.source.length()
+	size := (length + workers - 1) / workers
+	if size == 0 {
+		return p.aggregateRows(0, length, nil)
+	}
+
+	// Aggregate each chunk with a processor of its own. Every chunk's buckets
+	// are held until they are merged, so the chunks share a count of the
+	// buckets created towards MaxBuckets.
+	var created *int64
+	if limits := p.dataset.Limits; limits != nil && limits.MaxBuckets > 0 {
+		created = new(int64)
+	}
+	count := (length + size - 1) / size
+	chunks := make([]*queryProcessor, count)
+	partials := make([]*Resultset, count)
+	wg := sync.WaitGroup{}
+	for i := range chunks {
+		offset := i * size
+		end := offset + size
+		if end > length {
+			end = length
+		}
+		chunks[i] = &queryProcessor{
+			ctx:        p.ctx,
+			dataset:    p.dataset,
+			source:     p.source,
+			rowErrors:  p.rowErrors,
+			query:      p.query,
+			filters:    p.filters,
+			readers:    p.readers,
+			tipBuckets: map[*ResultBucket]*Query{},
+			created:    created,
+		}
+		wg.Add(1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			partials[i] = chunks[i].aggregateRows(start, end, nil)
+		}(i, offset, end)
+	}
+	wg.Wait()
+
+	// Collect the state of each chunk, then merge their results into the first.
+	for _, chunk := range chunks {
+		if chunk.err != nil {
+			p.err = chunk.err
+			return nil
+		}
+		for bucket, query := range chunk.tipBuckets {
+			p.tipBuckets[bucket] = query
+		}
+		p.composition = append(p.composition, chunk.composition...)
+		p.hasDatetime = p.hasDatetime || chunk.hasDatetime
+		p.hasRange = p.hasRange || chunk.hasRange
+		p.bucketCount += chunk.bucketCount
+	}
+	results := partials[0]
+	for _, partial := range partials[1:] {
+		p.mergeResultset(p.query, results, partial)
+		if p.err != nil {
+			return nil
+		}
+	}
+	return results
+}
+
+// mergeResultset merges the buckets of src into dst.
+func (p *queryProcessor) mergeResultset(query *Query, dst, src *Resultset) {
+	dst.bucketLookup = p.mergeBuckets(query.Bucket, dst.bucketLookup, src.bucketLookup)
+	dst.Aggregations = p.mergeAggregations(query.Aggregations, dst.Aggregations, src.Aggregations)
+}
+
+func (p *queryProcessor) mergeAggregations(aggregations map[string]*Query, dst, src map[string]*Resultset) map[string]*Resultset {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = map[string]*Resultset{}
+	}
+	for name, result := range src {
+		if existing, ok := dst[name]; ok {
+			p.mergeResultset(aggregations[name], existing, result)
+		} else {
+			dst[name] = result
+		}
+	}
+	return dst
+}
+
+// mergeBuckets merges the src buckets into dst. Buckets only in src are moved
+// across as they are, while buckets in both have their rows and children merged.
+func (p *queryProcessor) mergeBuckets(aggregate *Bucket, dst, src map[string]*ResultBucket) map[string]*ResultBucket {
+	limits := p.dataset.Limits
+	for value, bucket := range src {
+		if p.err != nil {
+			return dst
+		}
+		existing, ok := dst[value]
+		if !ok {
+			if limits != nil && limits.MaxBucketsPerLevel > 0 && len(dst) >= limits.MaxBucketsPerLevel {
+				p.err = &LimitError{"MaxBucketsPerLevel", limits.MaxBucketsPerLevel, bucketName(aggregate), value}
+				return dst
+			}
+			dst[value] = bucket
+			continue
+		}
+		existing.sourceRows = append(existing.sourceRows, bucket.sourceRows...)
+		existing.rowCount += bucket.rowCount
+		existing.bucketLookup = p.mergeBuckets(aggregate.Bucket, existing.bucketLookup, bucket.bucketLookup)
+		existing.Aggregations = p.mergeAggregations(aggregate.Aggregations, existing.Aggregations, bucket.Aggregations)
+
+		// The merged bucket no longer exists in the results, so isn't a tip
+		// and isn't counted.
+		delete(p.tipBuckets, bucket)
+		p.bucketCount--
+	}
+	return dst
+}
+
+// measureParallel measures the tip buckets across a number of workers.
+func (p *queryProcessor) measureParallel(workers int, scripts map[*Query][]expression) {
+	type tip struct {
+		bucket *ResultBucket
+		query  *Query
+	}
+	tips := make(chan tip)
+	errs := make(chan error, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tips {
+				err := p.ctx.Err()
+				if err != nil {
+					err = fmt.Errorf("Query cancelled while measuring: %w", err)
+				} else {
+					err = p.measureBucket(t.bucket, t.query, scripts[t.query])
+				}
+				if err != nil {
+					errs <- err
+					// Keep draining so the producer isn't blocked.
+					for range tips {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for bucket, query := range p.tipBuckets {
+		tips <- tip{bucket, query}
+	}
+	close(tips)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		p.err = err
+		return
+	}
+}
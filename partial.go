@@ -0,0 +1,279 @@
+package aggro
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// PartialResultset is the unfinished result of running a query against one
+// dataset. Rather than final metrics, its tip buckets hold the intermediate
+// state of each metric's measurer, so partials from many datasets can be
+// combined with Merge. A PartialResultset can be serialized to JSON to be sent
+// between processes.
+type PartialResultset struct {
+	Buckets      []*PartialBucket             `json:"buckets"`
+	Aggregations map[string]*PartialResultset `json:"aggregations,omitempty"`
+	// Errors holds the rows skipped by a lenient dataset, and is only set on
+	// the root of the partial.
+	Errors []*RowError `json:"errors,omitempty"`
+	// HasDatetime and HasRange record whether any datetime or range buckets
+	// were created, and so whether Merge fills their gaps as Run would. They
+	// are only set on the root of the partial.
+	HasDatetime bool `json:"has_datetime,omitempty"`
+	HasRange    bool `json:"has_range,omitempty"`
+}
+
+// PartialBucket is a bucket within a PartialResultset. States are keyed by
+// metric, e.g. salary:mean, and are only present on tip buckets.
+type PartialBucket struct {
+	Value        string                       `json:"value"`
+	RowCount     int                          `json:"row_count"`
+	States       map[string]*MeasurerState    `json:"states,omitempty"`
+	Buckets      []*PartialBucket             `json:"buckets,omitempty"`
+	Aggregations map[string]*PartialResultset `json:"aggregations,omitempty"`
+}
+
+// RunPartial aggregates the dataset's rows and measures each tip bucket,
+// returning the intermediate state rather than the final results. Gaps aren't
+// filled and selectors, sorting and pipelines aren't applied, as they depend on
+// every partial; Merge applies them once the partials are combined.
+func (set *Dataset) RunPartial(query *Query) (*PartialResultset, error) {
+	p := &queryProcessor{
+		ctx:     context.Background(),
+		dataset: set,
+		query:   query,
+	}
+	p.prepare()
+	if p.err = validateQuery("Query", query); p.err != nil {
+		return nil, p.err
+	}
+	if p.err = p.prepareBuckets(query); p.err != nil {
+		return nil, p.err
+	}
+	var results *Resultset
+	if set.Workers > 1 {
+		results = p.aggregateParallel(set.Workers)
+	} else {
+		results = p.aggregateRows(0, p.source.length(), nil)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	states := map[*ResultBucket]map[string]*MeasurerState{}
+	for bucket, query := range p.tipBuckets {
+		measurers, err := newMeasurers(query.Metrics)
+		if err != nil {
+			return nil, err
+		}
+		err = p.addMeasurerRows(query.Metrics, measurers, bucket.sourceRows)
+		if err != nil {
+			return nil, err
+		}
+		states[bucket] = map[string]*MeasurerState{}
+		for i, metric := range query.Metrics {
+			states[bucket][metric.Field+MetricDelimeter+metric.Type] = measurers[i].State()
+		}
+	}
+	partial := partialResultset(results, states)
+	partial.HasDatetime = p.hasDatetime
+	partial.HasRange = p.hasRange
+	if p.rowErrors != nil {
+		partial.Errors = p.rowErrors.sorted()
+	}
+	return partial, nil
+}
+
+func partialResultset(results *Resultset, states map[*ResultBucket]map[string]*MeasurerState) *PartialResultset {
+	return &PartialResultset{
+		Buckets:      partialBuckets(results.bucketLookup, states),
+		Aggregations: partialAggregations(results.Aggregations, states),
+	}
+}
+
+func partialAggregations(aggregations map[string]*Resultset, states map[*ResultBucket]map[string]*MeasurerState) map[string]*PartialResultset {
+	if len(aggregations) == 0 {
+		return nil
+	}
+	partials := map[string]*PartialResultset{}
+	for name, results := range aggregations {
+		partials[name] = partialResultset(results, states)
+	}
+	return partials
+}
+
+func partialBuckets(lookup map[string]*ResultBucket, states map[*ResultBucket]map[string]*MeasurerState) []*PartialBucket {
+	if len(lookup) == 0 {
+		return nil
+	}
+	buckets := make([]*PartialBucket, 0, len(lookup))
+	for value, bucket := range lookup {
+		buckets = append(buckets, &PartialBucket{
+			Value:        value,
+			RowCount:     bucket.rowCount,
+			States:       states[bucket],
+			Buckets:      partialBuckets(bucket.bucketLookup, states),
+			Aggregations: partialAggregations(bucket.Aggregations, states),
+		})
+	}
+	// Order the buckets so that a partial always serializes the same way.
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Value < buckets[j].Value
+	})
+	return buckets
+}
+
+// Merge combines partial results, created with RunPartial from the same query,
+// into a final Resultset. Measurer states of matching buckets are merged before
+// metrics are calculated, so metrics such as mean, median and cardinality are
+// correct across every partial. Gaps are then filled and selectors, sorting and
+// pipelines applied, just as Run would.
+func Merge(query *Query, partials ...*PartialResultset) (*Resultset, error) {
+	p := &queryProcessor{
+		ctx:     context.Background(),
+		dataset: &Dataset{},
+		query:   query,
+	}
+	p.prepare()
+	if p.err = validateQuery("Query", query); p.err != nil {
+		return nil, p.err
+	}
+
+	results := newResultset()
+	measurers := map[*ResultBucket][]measurer{}
+	rowErrs := []*RowError{}
+	for _, partial := range partials {
+		p.mergePartialResultset(query, results, partial, measurers)
+		if p.err != nil {
+			return nil, p.err
+		}
+		if partial != nil {
+			rowErrs = append(rowErrs, partial.Errors...)
+			p.hasDatetime = p.hasDatetime || partial.HasDatetime
+			p.hasRange = p.hasRange || partial.HasRange
+		}
+	}
+	p.fillDatetimeGaps(query, results)
+	p.fillRangeGaps(query, results)
+	p.results = results
+
+	p.measureMerged(measurers)
+	p.selectBuckets()
+	p.sort()
+	p.pipeline()
+	if p.err == nil {
+		// Row indexes are within each partial's dataset, so keep their order.
+		for _, err := range rowErrs {
+			p.results.Errors = append(p.results.Errors, err)
+		}
+	}
+	return p.results, p.err
+}
+
+func (p *queryProcessor) mergePartialResultset(query *Query, dst *Resultset, src *PartialResultset, measurers map[*ResultBucket][]measurer) {
+	if src == nil {
+		return
+	}
+	dst.bucketLookup = p.mergePartialBuckets(query.Bucket, query, dst.bucketLookup, src.Buckets, measurers)
+	if p.err != nil {
+		return
+	}
+	dst.Aggregations = p.mergePartialAggregations(query.Aggregations, dst.Aggregations, src.Aggregations, measurers)
+}
+
+func (p *queryProcessor) mergePartialAggregations(aggregations map[string]*Query, dst map[string]*Resultset, src map[string]*PartialResultset, measurers map[*ResultBucket][]measurer) map[string]*Resultset {
+	for name, partial := range src {
+		query, ok := aggregations[name]
+		if !ok {
+			p.err = fmt.Errorf("Partial aggregation %s is not in the query", name)
+			return dst
+		}
+		if dst == nil {
+			dst = map[string]*Resultset{}
+		}
+		if dst[name] == nil {
+			dst[name] = newResultset()
+		}
+		p.mergePartialResultset(query, dst[name], partial, measurers)
+		if p.err != nil {
+			return dst
+		}
+	}
+	return dst
+}
+
+func (p *queryProcessor) mergePartialBuckets(aggregate *Bucket, query *Query, dst map[string]*ResultBucket, src []*PartialBucket, measurers map[*ResultBucket][]measurer) map[string]*ResultBucket {
+	for _, partial := range src {
+		if aggregate == nil {
+			p.err = fmt.Errorf("Partial bucket %s is deeper than the query", partial.Value)
+			return dst
+		}
+		bucket := ensureBucket(aggregate, dst, parseBucketKey(aggregate, partial.Value))
+		bucket.rowCount += partial.RowCount
+		dst[partial.Value] = bucket
+
+		if aggregate.Bucket == nil {
+			p.tipBuckets[bucket] = query
+			p.err = mergeMeasurerStates(bucket, query, partial.States, measurers)
+			if p.err != nil {
+				return dst
+			}
+		}
+
+		bucket.bucketLookup = p.mergePartialBuckets(aggregate.Bucket, query, bucket.bucketLookup, partial.Buckets, measurers)
+		if p.err != nil {
+			return dst
+		}
+		bucket.Aggregations = p.mergePartialAggregations(aggregate.Aggregations, bucket.Aggregations, partial.Aggregations, measurers)
+		if p.err != nil {
+			return dst
+		}
+	}
+	return dst
+}
+
+// mergeMeasurerStates merges the measurer state of each of the query's metrics
+// into the tip bucket's measurers, creating them if required.
+func mergeMeasurerStates(bucket *ResultBucket, query *Query, states map[string]*MeasurerState, measurers map[*ResultBucket][]measurer) error {
+	ms := measurers[bucket]
+	if ms == nil {
+		var err error
+		ms, err = newMeasurers(query.Metrics)
+		if err != nil {
+			return err
+		}
+		measurers[bucket] = ms
+	}
+	for i, metric := range query.Metrics {
+		if state := states[metric.Field+MetricDelimeter+metric.Type]; state != nil {
+			ms[i].Merge(state)
+		}
+	}
+	return nil
+}
+
+// measureMerged sets the metrics of each tip bucket from its merged measurers.
+// Buckets created by filling gaps have no measurers, so are given empty ones.
+func (p *queryProcessor) measureMerged(measurers map[*ResultBucket][]measurer) {
+	if p.err != nil {
+		return
+	}
+	scripts := p.parseScripts()
+	if p.err != nil {
+		return
+	}
+	for bucket, query := range p.tipBuckets {
+		ms := measurers[bucket]
+		if ms == nil {
+			ms, p.err = newMeasurers(query.Metrics)
+			if p.err != nil {
+				return
+			}
+		}
+		p.err = setBucketMetrics(bucket, query, ms, scripts[query])
+		if p.err != nil {
+			return
+		}
+	}
+}
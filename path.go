@@ -0,0 +1,79 @@
+package aggro
+
+import (
+	"reflect"
+	"strings"
+)
+
+// fieldPathDelimiter separates the parts of a field name that is a path into
+// nested objects, e.g. address.city.
+const fieldPathDelimiter = "."
+
+// fieldValue returns the datum of the field with the given name from a row's
+// data, and whether the row has it. A name such as address.city or manager.id
+// is a path into nested objects, which may be maps with string keys or structs,
+// unless the data has a key for the whole name. Structs' fields are matched by
+// their json tag, or by their name if they have none. A row missing one of the
+// objects along the path, or with a nil one, has a nil datum for the field.
+func fieldValue(data map[string]interface{}, name string) (interface{}, bool) {
+	if datum, ok := data[name]; ok || !strings.Contains(name, fieldPathDelimiter) {
+		return datum, ok
+	}
+	parts := strings.Split(name, fieldPathDelimiter)
+	datum, ok := data[parts[0]]
+	for _, part := range parts[1:] {
+		if !ok || datum == nil {
+			return nil, true
+		}
+		datum, ok = objectValue(datum, part)
+	}
+	return datum, ok
+}
+
+// objectValue returns the value with the given key from a map or struct, and
+// whether it has one. Pointers to maps and structs are followed.
+func objectValue(object interface{}, key string) (interface{}, bool) {
+	if m, ok := object.(map[string]interface{}); ok {
+		value, ok := m[key]
+		return value, ok
+	}
+	value := reflect.ValueOf(object)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil, true
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		v := value.MapIndex(reflect.ValueOf(key).Convert(value.Type().Key()))
+		if !v.IsValid() {
+			return nil, false
+		}
+		return v.Interface(), true
+	case reflect.Struct:
+		t := value.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				// Unexported fields can't be read.
+				continue
+			}
+			name := field.Name
+			if tag, ok := field.Tag.Lookup("json"); ok {
+				if tag = strings.Split(tag, ",")[0]; tag == "-" {
+					continue
+				} else if tag != "" {
+					name = tag
+				}
+			}
+			if name == key {
+				return value.Field(i).Interface(), true
+			}
+		}
+	}
+	return nil, false
+}
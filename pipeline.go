@@ -0,0 +1,232 @@
+package aggro
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// PipelineMetric computes a value for each of a bucket's siblings from a metric
+// that has already been measured on them. Sibling buckets are processed in their
+// sorted order, so pipelines are generally paired with a sorted date histogram.
+type PipelineMetric struct {
+	// Type is one of derivative, cumulative_sum, moving_average or
+	// percent_of_total.
+	Type string
+	// Metric is the key of the metric the pipeline reads from, e.g. salary:sum.
+	Metric string
+	// Name is the key the result is stored under in each bucket's Metrics. It
+	// defaults to the Metric key followed by the Type, e.g. salary:sum:derivative.
+	Name string
+	// Window is the number of buckets, up to and including the current bucket,
+	// that a moving average is calculated over. Defaults to 5.
+	Window int
+	// Model is the moving average model, either simple or ewma. Defaults to simple.
+	Model string
+	// Alpha is the ewma smoothing factor between 0 and 1. Defaults to 0.3.
+	Alpha float64
+}
+
+// key returns the metric key that the pipeline result is stored under.
+func (pipeline *PipelineMetric) key() string {
+	if pipeline.Name != "" {
+		return pipeline.Name
+	}
+	return pipeline.Metric + MetricDelimeter + pipeline.Type
+}
+
+// validatePipelines ensures each of the bucket's pipelines is of a known type,
+// and reads a metric that is measured on its results or computed by an earlier
+// pipeline.
+func validatePipelines(name string, depth int, query *Query, bucket *Bucket) error {
+	keys := bucketMetricKeys(query, bucket)
+	for _, pipeline := range bucket.Pipelines {
+		switch pipeline.Type {
+		case "derivative", "cumulative_sum", "percent_of_total":
+		case "moving_average":
+			switch pipeline.Model {
+			case "", "simple", "ewma":
+			default:
+				return fmt.Errorf("Unknown moving average model: %s", pipeline.Model)
+			}
+		default:
+			return fmt.Errorf("Unknown pipeline metric: %s", pipeline.Type)
+		}
+		if !keys[pipeline.Metric] {
+			return fmt.Errorf("%s pipeline at depth %d reads metric %s, which isn't measured at that level", name, depth, pipeline.Metric)
+		}
+		keys[pipeline.key()] = true
+	}
+	return nil
+}
+
+// apply runs the pipeline across the sibling buckets, storing a result in each.
+func (pipeline *PipelineMetric) apply(results []*ResultBucket) error {
+	// Grab the source value of every bucket, nil where there isn't one.
+	values := make([]*float64, len(results))
+	for i, result := range results {
+		if value, ok := metricFloat(result.Metrics[pipeline.Metric]); ok {
+			values[i] = &value
+		}
+	}
+
+	var computed []interface{}
+	switch pipeline.Type {
+	case "derivative":
+		computed = derivative(values)
+	case "cumulative_sum":
+		computed = cumulativeSum(values)
+	case "moving_average":
+		window := pipeline.Window
+		if window <= 0 {
+			window = 5
+		}
+		switch pipeline.Model {
+		case "", "simple":
+			computed = simpleMovingAverage(values, window)
+		case "ewma":
+			alpha := pipeline.Alpha
+			if alpha <= 0 || alpha > 1 {
+				alpha = 0.3
+			}
+			computed = ewmaMovingAverage(values, window, alpha)
+		default:
+			return fmt.Errorf("Unknown moving average model: %s", pipeline.Model)
+		}
+	case "percent_of_total":
+		computed = percentOfTotal(values)
+	default:
+		return fmt.Errorf("Unknown pipeline metric: %s", pipeline.Type)
+	}
+
+	key := pipeline.key()
+	for i, result := range results {
+		if result.Metrics == nil {
+			result.Metrics = map[string]interface{}{}
+		}
+		result.Metrics[key] = computed[i]
+	}
+	return nil
+}
+
+// derivative is the difference between each value and the previous value. The
+// first bucket, and any bucket either side of a missing value, has no result.
+func derivative(values []*float64) []interface{} {
+	results := make([]interface{}, len(values))
+	for i := 1; i < len(values); i++ {
+		if values[i] != nil && values[i-1] != nil {
+			results[i] = *values[i] - *values[i-1]
+		}
+	}
+	return results
+}
+
+// cumulativeSum is the running total of values, treating missing values as zero.
+func cumulativeSum(values []*float64) []interface{} {
+	results := make([]interface{}, len(values))
+	total := 0.0
+	for i, value := range values {
+		if value != nil {
+			total += *value
+		}
+		results[i] = total
+	}
+	return results
+}
+
+// simpleMovingAverage is the mean of the values in the window ending at each
+// bucket. Missing values are skipped.
+func simpleMovingAverage(values []*float64, window int) []interface{} {
+	results := make([]interface{}, len(values))
+	for i := range values {
+		total := 0.0
+		count := 0
+		for _, value := range values[windowStart(i, window) : i+1] {
+			if value != nil {
+				total += *value
+				count++
+			}
+		}
+		if count > 0 {
+			results[i] = total / float64(count)
+		}
+	}
+	return results
+}
+
+// ewmaMovingAverage is the exponentially weighted mean of the values in the
+// window ending at each bucket, with more recent values weighted more heavily.
+// Missing values are skipped.
+func ewmaMovingAverage(values []*float64, window int, alpha float64) []interface{} {
+	results := make([]interface{}, len(values))
+	for i := range values {
+		var average *float64
+		for _, value := range values[windowStart(i, window) : i+1] {
+			if value == nil {
+				continue
+			}
+			if average == nil {
+				v := *value
+				average = &v
+				continue
+			}
+			*average = alpha*(*value) + (1-alpha)*(*average)
+		}
+		if average != nil {
+			results[i] = *average
+		}
+	}
+	return results
+}
+
+// windowStart returns the index of the first value in a window ending at i.
+func windowStart(i, window int) int {
+	if start := i - window + 1; start > 0 {
+		return start
+	}
+	return 0
+}
+
+// percentOfTotal is each value as a percentage of the sum of all values.
+func percentOfTotal(values []*float64) []interface{} {
+	results := make([]interface{}, len(values))
+	total := 0.0
+	for _, value := range values {
+		if value != nil {
+			total += *value
+		}
+	}
+	if total == 0 {
+		return results
+	}
+	for i, value := range values {
+		if value != nil {
+			results[i] = *value / total * 100
+		}
+	}
+	return results
+}
+
+// metricFloat converts a metric result to a float64, if it is numerical.
+func metricFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case decimal.Decimal:
+		f, _ := v.Float64()
+		return f, true
+	case *decimal.Decimal:
+		if v == nil {
+			return 0, false
+		}
+		f, _ := v.Float64()
+		return f, true
+	}
+	return 0, false
+}
@@ -1,6 +1,7 @@
 package aggro
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -11,22 +12,45 @@ import (
 // MetricDelimeter is a string used to separate metric field's from names.
 var MetricDelimeter = ":"
 
+// contextCheckInterval is the number of rows aggregated between checks for
+// cancellation of the query's context.
+const contextCheckInterval = 1024
+
 type queryProcessor struct {
+	ctx         context.Context
 	dataset     *Dataset
+	source      rowSource
 	query       *Query
-	tipBuckets  map[*ResultBucket]bool
+	tipBuckets  map[*ResultBucket]*Query
 	measurables []*[]Cell
 	err         error
 	results     *Resultset
 	composition []interface{}
 	hasDatetime bool
 	hasRange    bool
+	bucketCount int
+	// created counts the buckets created by every chunk of a parallel query,
+	// and is nil otherwise.
+	created *int64
+	// filters are the query's filters, prepared once for matching each row.
+	filters map[*Filter]*filterMatcher
+	// readers are the readers of the fields the query's buckets are on.
+	readers map[*Bucket]fieldReader
+	// rowErrors collects the rows skipped by a lenient query, and is nil
+	// otherwise.
+	rowErrors *rowErrors
 }
 
 func (p *queryProcessor) Run() (*Resultset, error) {
 	p.prepare()
 	p.aggregate()
 	p.measure()
+	p.selectBuckets()
+	p.sort()
+	p.pipeline()
+	if p.err == nil && p.rowErrors != nil {
+		p.results.Errors = p.rowErrors.list()
+	}
 	return p.results, p.err
 }
 
@@ -34,9 +58,18 @@ func (p *queryProcessor) prepare() {
 	if p.err != nil {
 		return
 	}
+	if p.ctx == nil {
+		p.ctx = context.Background()
+	}
+	if p.source == nil {
+		p.source = p.dataset.source()
+	}
+	if p.dataset.Lenient != nil {
+		p.rowErrors = newRowErrors(p.dataset.Lenient)
+	}
 
 	// Initialise the root & tip buckets, and full bucket lookup.
-	p.tipBuckets = map[*ResultBucket]bool{}
+	p.tipBuckets = map[*ResultBucket]*Query{}
 }
 
 // aggregate is responsible for sorting the dataset's rows into buckets.
@@ -44,125 +77,475 @@ func (p *queryProcessor) aggregate() {
 	if p.err != nil {
 		return
 	}
-	if p.query.Bucket == nil {
-		p.err = errors.New("Query has no root bucket")
+	p.err = validateQuery("Query", p.query)
+	if p.err != nil {
+		return
+	}
+	p.err = p.prepareBuckets(p.query)
+	if p.err != nil {
 		return
 	}
 	// Loop over each row, adding all nest query buckets to the value buckets.
-	buckets := map[string]*ResultBucket{}
-	for i, row := range p.dataset.Rows {
-		buckets = p.recurse(0, i, row, p.query.Bucket, buckets)
+	var results *Resultset
+	if p.dataset.Workers > 1 {
+		results = p.aggregateParallel(p.dataset.Workers)
+	} else {
+		results = p.aggregateRows(0, p.source.length(), nil)
 	}
+	if p.err != nil {
+		return
+	}
+
+	p.fillDatetimeGaps(p.query, results)
 
-	buckets = p.fillDatetimeGaps(buckets)
+	p.fillRangeGaps(p.query, results)
 
-	buckets = p.fillRangeGaps(buckets)
+	results.Composition = p.composition
+	p.attach(p.query, results)
+	p.results = results
+}
+
+// attach records the query and the rows it read on the results and any
+// aggregations within them.
+func (p *queryProcessor) attach(query *Query, results *Resultset) {
+	results.query = query
+	results.source = p.source
+	p.attachAggregations(query.Aggregations, results.Aggregations)
+	p.attachBuckets(query.Bucket, results.bucketLookup)
+}
 
-	p.results = &Resultset{
-		Buckets:     p.sort(buckets),
-		Composition: p.composition,
+func (p *queryProcessor) attachAggregations(aggregations map[string]*Query, results map[string]*Resultset) {
+	for name, query := range aggregations {
+		if aggregationResults, ok := results[name]; ok {
+			p.attach(query, aggregationResults)
+		}
 	}
 }
 
-func (p *queryProcessor) recurse(depth, index int, row map[string]Cell, aggregate *Bucket, results map[string]*ResultBucket) map[string]*ResultBucket {
-	// If there's no aggregate, we're done.
-	if aggregate == nil {
-		return results
+func (p *queryProcessor) attachBuckets(bucket *Bucket, results map[string]*ResultBucket) {
+	if bucket == nil {
+		return
+	}
+	for _, result := range results {
+		p.attachAggregations(bucket.Aggregations, result.Aggregations)
+		p.attachBuckets(bucket.Bucket, result.bucketLookup)
 	}
+}
 
-	// Ensure we have the details required to bucket on.
-	if aggregate.Field.Type == fieldTypeDatetime && aggregate.DatetimeOptions == nil {
-		p.err = errors.New("Bucketing by datetime without DatetimeOptions set")
+// aggregateRows adds each of the rows from start up to end to the query's
+// buckets within results, creating them if results is nil.
+func (p *queryProcessor) aggregateRows(start, end int, results *Resultset) *Resultset {
+	if results == nil {
+		results = newResultset()
+	}
+	for index := start; index < end; index++ {
+		if (index-start)%contextCheckInterval == 0 && p.cancelled("aggregating") {
+			break
+		}
+		results = p.recurseQuery(0, index, p.query, results)
+		if p.err != nil {
+			break
+		}
+	}
+	return results
+}
+
+// cancelled sets the processor error if the query's context is done, wrapping
+// the context's error with the phase of the query that was running.
+func (p *queryProcessor) cancelled(phase string) bool {
+	if err := p.ctx.Err(); err != nil {
+		p.err = fmt.Errorf("Query cancelled while %s: %w", phase, err)
+		return true
+	}
+	return false
+}
+
+// validateQuery ensures the query and any of its sibling aggregations have
+// something to bucket on.
+func validateQuery(name string, query *Query) error {
+	if query.Bucket == nil && len(query.Aggregations) == 0 {
+		return fmt.Errorf("%s has no root bucket", name)
+	}
+	if err := validateAggregations(query.Aggregations); err != nil {
+		return err
+	}
+	depth := 0
+	for bucket := query.Bucket; bucket != nil; bucket = bucket.Bucket {
+		if bucket.FilterOptions != nil && bucket.FiltersOptions != nil {
+			return fmt.Errorf("%s bucket at depth %d has both FilterOptions and FiltersOptions set", name, depth)
+		}
+		if bucket.Field != nil && elementType(bucket.Field.Type) == fieldTypeDatetime && bucket.DatetimeOptions == nil {
+			return errors.New("Bucketing by datetime without DatetimeOptions set")
+		}
+		if err := validateSelectors(name, depth, query, bucket); err != nil {
+			return err
+		}
+		if err := validatePipelines(name, depth, query, bucket); err != nil {
+			return err
+		}
+		if err := validateAggregations(bucket.Aggregations); err != nil {
+			return err
+		}
+		depth++
+	}
+	return nil
+}
+
+// prepareBuckets prepares the filters of the query's buckets, and those of its
+// aggregations, for matching against the dataset's rows, and resolves the
+// reader of each field they bucket on.
+func (p *queryProcessor) prepareBuckets(query *Query) error {
+	if p.filters == nil {
+		p.filters = map[*Filter]*filterMatcher{}
+		p.readers = map[*Bucket]fieldReader{}
+	}
+	for _, aggregation := range query.Aggregations {
+		if err := p.prepareBuckets(aggregation); err != nil {
+			return err
+		}
+	}
+	for bucket := query.Bucket; bucket != nil; bucket = bucket.Bucket {
+		if bucket.Field != nil {
+			p.readers[bucket] = p.source.field(bucket.Field.Name)
+		}
+		filters := []*Filter{}
+		if bucket.FilterOptions != nil {
+			filters = append(filters, bucket.FilterOptions.Filter)
+		}
+		if bucket.FiltersOptions != nil {
+			for _, filter := range bucket.FiltersOptions.Filters {
+				filters = append(filters, filter)
+			}
+		}
+		for _, filter := range filters {
+			if filter == nil {
+				continue
+			}
+			matcher, err := newFilterMatcher(p.filterField, filter)
+			if err != nil {
+				return err
+			}
+			matcher.bind(p.source)
+			p.filters[filter] = matcher
+		}
+		for _, aggregation := range bucket.Aggregations {
+			if err := p.prepareBuckets(aggregation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterField returns the table's definition of a field that a filter tests.
+func (p *queryProcessor) filterField(name string) (*Field, error) {
+	field := p.dataset.Table.field(name)
+	if field == nil {
+		return nil, fmt.Errorf("Unknown filter field: %s", name)
+	}
+	return field, nil
+}
+
+// matchFilter determines whether the row at index matches the prepared filter.
+// A nil filter matches every row.
+func (p *queryProcessor) matchFilter(filter *Filter, index int) (bool, error) {
+	matcher, ok := p.filters[filter]
+	if !ok {
+		return true, nil
+	}
+	return matcher.match(func(m *filterMatcher) interface{} {
+		value, _ := m.read(index)
+		return value
+	})
+}
+
+// bucketMetricKeys returns the keys of the metrics measured on the bucket's
+// results. Only a query's tip buckets are measured, with its metrics and
+// scripts, so any other bucket has none.
+func bucketMetricKeys(query *Query, bucket *Bucket) map[string]bool {
+	keys := map[string]bool{}
+	if bucket.Bucket != nil {
+		return keys
+	}
+	for _, metric := range query.Metrics {
+		keys[metric.Field+MetricDelimeter+metric.Type] = true
+	}
+	for _, script := range query.Scripts {
+		keys[script.Name] = true
+	}
+	return keys
+}
+
+func validateAggregations(aggregations map[string]*Query) error {
+	for name, query := range aggregations {
+		if query == nil {
+			return fmt.Errorf("Aggregation %s is nil", name)
+		}
+		if err := validateQuery("Aggregation "+name, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newResultset() *Resultset {
+	return &Resultset{
+		bucketLookup: map[string]*ResultBucket{},
+	}
+}
+
+// recurseQuery adds the row to the query's root bucket and to each of the
+// query's sibling aggregations.
+func (p *queryProcessor) recurseQuery(depth, index int, query *Query, results *Resultset) *Resultset {
+	if results == nil {
+		results = newResultset()
+	}
+	results.bucketLookup = p.recurse(depth, index, query.Bucket, query, results.bucketLookup)
+	results.Aggregations = p.recurseAggregations(depth, index, query.Aggregations, results.Aggregations)
+	return results
+}
+
+// recurseAggregations adds the row to each of the named sibling aggregations.
+func (p *queryProcessor) recurseAggregations(depth, index int, aggregations map[string]*Query, results map[string]*Resultset) map[string]*Resultset {
+	if len(aggregations) == 0 {
 		return results
 	}
+	if results == nil {
+		results = map[string]*Resultset{}
+	}
+	for name, query := range aggregations {
+		results[name] = p.recurseQuery(depth, index, query, results[name])
+	}
+	return results
+}
 
-	// Grab the cell that we're aggregating on.
-	cell := row[aggregate.Field.Name]
+func (p *queryProcessor) recurse(depth, index int, aggregate *Bucket, query *Query, results map[string]*ResultBucket) map[string]*ResultBucket {
+	// If there's no aggregate, we're done.
+	if aggregate == nil {
+		return results
+	}
 
-	// Handle nil cell.
-	if cell == nil {
+	// Grab the keys of each of the buckets this row belongs in.
+	keys := p.bucketKeys(depth, index, aggregate)
+	if p.err != nil {
 		return results
 	}
 
-	// And grab the underlying aggregatable string value.
-	value := ""
+	// Bump depth for the next level.
+	depth++
 
-	switch tCell := cell.(type) {
-	case *StringCell:
-		// String Cell's are easy, it's just the value.
-		value = tCell.value
-		p.composition = append(p.composition, tCell.data)
-	case *DatetimeCell:
-		p.hasDatetime = true
-		// Datetime Cell's are a bit more complicated, and need the period value.
-		value, p.err = tCell.ValueForPeriod(aggregate.DatetimeOptions.Period, aggregate.DatetimeOptions.Location)
-		if p.err != nil {
+	for _, key := range keys {
+		// Ensure we have a result bucket for this key, making one if we don't.
+		value := bucketKeyString(key)
+		if !p.addBucket(aggregate, results, value) {
 			return results
 		}
-		p.composition = append(p.composition, tCell.data)
-	case *NumberCell:
-		if aggregate.RangeOptions != nil {
-			p.hasRange = true
-			value, p.err = tCell.ValueForPeriod(aggregate.RangeOptions.Period)
+		bucket := ensureBucket(aggregate, results, key)
+		bucket.rowCount++
+
+		// If there's no next bucket, we're at the deepest point. Add data to measure.
+		if aggregate.Bucket == nil {
+			bucket.sourceRows = append(bucket.sourceRows, index)
+			p.tipBuckets[bucket] = query
+		}
+
+		// Recurse to next level, passing in the children as the results.
+		bucket.bucketLookup = p.recurse(depth, index, aggregate.Bucket, query, bucket.bucketLookup)
+
+		// Sibling aggregations nested within this bucket receive the same row.
+		bucket.Aggregations = p.recurseAggregations(depth, index, aggregate.Aggregations, bucket.Aggregations)
+
+		// Update the current results bucket with the new values.
+		results[value] = bucket
+	}
+	return results
+}
+
+// bucketKeys returns the typed key of each bucket that the row should be added
+// to for the given aggregate. A row without a value for the aggregate is not
+// added to any bucket.
+func (p *queryProcessor) bucketKeys(depth, index int, aggregate *Bucket) []interface{} {
+	// Filter buckets are based on predicates rather than a single field value.
+	if aggregate.FilterOptions != nil {
+		var ok bool
+		ok, p.err = p.matchFilter(aggregate.FilterOptions.Filter, index)
+		if p.err != nil || !ok {
+			return nil
+		}
+		return []interface{}{aggregate.FilterOptions.Value}
+	}
+	if aggregate.FiltersOptions != nil {
+		keys := []interface{}{}
+		for name, filter := range aggregate.FiltersOptions.Filters {
+			var ok bool
+			ok, p.err = p.matchFilter(filter, index)
 			if p.err != nil {
-				return results
+				return nil
+			}
+			if ok {
+				keys = append(keys, name)
 			}
-			p.composition = append(p.composition, tCell.data)
-		} else {
-			p.err = fmt.Errorf("Non aggregatable cell found without RangeOptions at depth %d, index %d", depth, index)
 		}
-	default:
-		p.err = fmt.Errorf("Non aggregatable cell found at depth %d, index %d", depth, index)
-		return results
+		return keys
+	}
+
+	// Ensure we have the details required to bucket on.
+	if aggregate.Field == nil {
+		p.err = fmt.Errorf("Bucket without Field or filter options found at depth %d", depth)
+		return nil
 	}
 
-	// Ensure we have a result bucket for this value, making one if we don't.
-	bucket := ensureValueBucket(results, value)
+	// Grab the value of the cell that we're aggregating on.
+	cell, data := p.readers[aggregate](index)
 
-	// If there's no next bucket, we're at the deepest point. Add data to measure.
-	if aggregate.Bucket == nil {
-		bucket.sourceRows = append(bucket.sourceRows, row)
-		p.tipBuckets[bucket] = true
+	// Handle nil cell, which only boolean buckets may keep.
+	if cell == nil {
+		if aggregate.BooleanOptions != nil && aggregate.BooleanOptions.Missing {
+			return []interface{}{nil}
+		}
+		return nil
 	}
 
-	// Bump depth and recurse to next level, passing in the children as the results.
-	depth++
-	bucket.bucketLookup = p.recurse(depth, index, row, aggregate.Bucket, bucket.bucketLookup)
+	var keys []interface{}
+	if elements, ok := cell.([]interface{}); ok {
+		// Arrays put the row into the bucket of each of their distinct elements.
+		keys = make([]interface{}, 0, len(elements))
+		seen := map[string]bool{}
+		for _, element := range elements {
+			key, ok := p.bucketKey(depth, index, aggregate, element)
+			if !ok {
+				return nil
+			}
+			if value := bucketKeyString(key); !seen[value] {
+				seen[value] = true
+				keys = append(keys, key)
+			}
+		}
+	} else {
+		key, ok := p.bucketKey(depth, index, aggregate, cell)
+		if !ok {
+			return nil
+		}
+		keys = []interface{}{key}
+	}
+	// Columns don't hold the data rows were added from.
+	if data != nil && len(keys) > 0 {
+		p.composition = append(p.composition, data)
+	}
+	return keys
+}
 
-	// Update the current results bucket with the new values, then return.
-	results[value] = bucket
-	return results
+// bucketKey returns the typed key of the aggregate's bucket for a single value
+// of the row at index, or false if the value can't be bucketed.
+func (p *queryProcessor) bucketKey(depth, index int, aggregate *Bucket, cell interface{}) (interface{}, bool) {
+	var key interface{}
+
+	switch tCell := cell.(type) {
+	case string:
+		// String Cell's are easy, it's just the value.
+		key = tCell
+	case *time.Time:
+		// The bucket's field may not be declared as a datetime, so there may
+		// be no period to bucket by.
+		if aggregate.DatetimeOptions == nil {
+			p.rowError(index, aggregate.Field.Name, "", fmt.Errorf("Non aggregatable cell found without DatetimeOptions at depth %d, index %d", depth, index))
+			return nil, false
+		}
+		p.hasDatetime = true
+		// Datetime Cell's are a bit more complicated, and need the period start.
+		key, p.err = datetimeKeyForPeriod(tCell, aggregate.DatetimeOptions.Period, aggregate.DatetimeOptions.Location)
+		if p.err != nil {
+			return nil, false
+		}
+	case bool:
+		key = tCell
+	case *decimal.Decimal:
+		// Without RangeOptions, numbers are bucketed by their exact value.
+		if aggregate.RangeOptions == nil {
+			key = *tCell
+			break
+		}
+		p.hasRange = true
+		key, p.err = rangeValueForPeriod(tCell, aggregate.RangeOptions.Period)
+		if p.err != nil {
+			return nil, false
+		}
+	default:
+		p.rowError(index, aggregate.Field.Name, "", fmt.Errorf("Non aggregatable cell found at depth %d, index %d", depth, index))
+		return nil, false
+	}
+	return key, true
 }
 
-func ensureValueBucket(results map[string]*ResultBucket, value string) *ResultBucket {
+// ensureBucket returns the bucket of the results with the key, making one for
+// the aggregate if there isn't one. Buckets are looked up by the string form
+// of their key.
+func ensureBucket(aggregate *Bucket, results map[string]*ResultBucket, key interface{}) *ResultBucket {
+	value := bucketKeyString(key)
 	bucket := results[value]
 	if bucket == nil {
 		bucket = &ResultBucket{
+			Key:          key,
 			Value:        value,
+			Label:        bucketLabel(aggregate, key),
 			bucketLookup: map[string]*ResultBucket{},
 		}
+		if key == nil {
+			// The missing bucket has no value, only a label.
+			bucket.Value = ""
+		}
 	}
 	return bucket
 }
 
-func (p *queryProcessor) fillDatetimeGaps(results map[string]*ResultBucket) map[string]*ResultBucket {
-	if !p.hasDatetime {
-		return results
+// bucketLabel returns the label of the aggregate's bucket with the key.
+func bucketLabel(aggregate *Bucket, key interface{}) string {
+	options := aggregate.BooleanOptions
+	if key == nil {
+		if options != nil && options.MissingLabel != "" {
+			return options.MissingLabel
+		}
+		return missingBucketLabel
+	}
+	value := bucketKeyString(key)
+	if options != nil {
+		label := ""
+		switch value {
+		case "true":
+			label = options.TrueLabel
+		case "false":
+			label = options.FalseLabel
+		}
+		if label != "" {
+			return label
+		}
 	}
-	return p.fillBucketDatetimeGaps(p.query.Bucket, results)
+	return value
 }
 
-func (p *queryProcessor) fillBucketDatetimeGaps(bucket *Bucket, results map[string]*ResultBucket) map[string]*ResultBucket {
-	if bucket == nil || len(results) < 0 {
+func (p *queryProcessor) fillDatetimeGaps(query *Query, results *Resultset) {
+	if !p.hasDatetime || p.err != nil {
+		return
+	}
+	results.bucketLookup = p.fillBucketDatetimeGaps(query.Bucket, query, results.bucketLookup)
+	for name, aggregation := range query.Aggregations {
+		if result, ok := results.Aggregations[name]; ok {
+			p.fillDatetimeGaps(aggregation, result)
+		}
+	}
+}
+
+func (p *queryProcessor) fillBucketDatetimeGaps(bucket *Bucket, query *Query, results map[string]*ResultBucket) map[string]*ResultBucket {
+	if bucket == nil || p.err != nil {
 		return results
 	}
-	if (bucket.Field.Type == fieldTypeDatetime) || p.hasRange {
-		// Get the max and min values.
-		var min, max *string
+	if bucket.Field != nil && elementType(bucket.Field.Type) == fieldTypeDatetime && bucket.DatetimeOptions != nil {
+		// Get the max and min keys.
+		var min, max *time.Time
 		// Set the min to the start if there is one.
 		if bucket.DatetimeOptions.Start != nil {
-			var start string
-			start, p.err = datetimeValueForPeriod(
+			var start time.Time
+			start, p.err = datetimeKeyForPeriod(
 				bucket.DatetimeOptions.Start,
 				bucket.DatetimeOptions.Period,
 				bucket.DatetimeOptions.Location,
@@ -174,8 +557,8 @@ func (p *queryProcessor) fillBucketDatetimeGaps(bucket *Bucket, results map[stri
 		}
 		// Set the max to the end if there is one.
 		if bucket.DatetimeOptions.End != nil {
-			var end string
-			end, p.err = datetimeValueForPeriod(
+			var end time.Time
+			end, p.err = datetimeKeyForPeriod(
 				bucket.DatetimeOptions.End,
 				bucket.DatetimeOptions.Period,
 				bucket.DatetimeOptions.Location,
@@ -185,51 +568,48 @@ func (p *queryProcessor) fillBucketDatetimeGaps(bucket *Bucket, results map[stri
 			}
 			max = &end
 		}
-		// Now extend the start and end depending on the values in the results.
-		for key := range results {
-			value := key
-			// Min being nil means max is too. Set them to the first result.
-			if min == nil {
-				min = &value
-				max = &value
-			} else {
-				if *min > value {
-					min = &value
-				}
-				if *max < value {
-					max = &value
-				}
+		// Now extend the start and end depending on the keys in the results.
+		for _, result := range results {
+			key, ok := result.Key.(time.Time)
+			if !ok {
+				continue
+			}
+			if min == nil || min.After(key) {
+				min = &key
+			}
+			if max == nil || max.Before(key) {
+				max = &key
 			}
 		}
-		// No need to do anything if we only have a single bucket length.
-		if *min == *max {
+		// No need to do anything if we have no buckets or a single bucket length.
+		if min == nil || max == nil || min.Equal(*max) {
 			return results
 		}
 
-		loopValue := *min
-		var loopDate time.Time
-		loopDate, p.err = time.Parse(time.RFC3339, loopValue)
-		if p.err != nil {
-			return results
-		}
 		// Now loop until we hit the max point, ensuring each period exists.
-		for loopValue <= *max {
+		loopKey := *min
+		periods := 0
+		for !loopKey.After(*max) {
+			periods++
+			loopValue := bucketKeyString(loopKey)
+			if !p.checkGapFill(bucket, periods, loopValue) || !p.addBucket(bucket, results, loopValue) {
+				return results
+			}
+
 			// Make sure this period exists.
-			results[loopValue] = ensureValueBucket(results, loopValue)
+			results[loopValue] = ensureBucket(bucket, results, loopKey)
 			if bucket.Bucket == nil {
-				p.tipBuckets[results[loopValue]] = true
+				p.tipBuckets[results[loopValue]] = query
 			}
 
 			// Now bump the date up one period, and loop.
-			date, err := datetimeAddPeriod(&loopDate, bucket.DatetimeOptions.Period)
+			date, err := datetimeAddPeriod(&loopKey, bucket.DatetimeOptions.Period)
 			if err != nil {
 				p.err = err
 				return results
 			}
-
-			loopDate = *date
-			loopValue, p.err = datetimeValueForPeriod(
-				&loopDate,
+			loopKey, p.err = datetimeKeyForPeriod(
+				date,
 				bucket.DatetimeOptions.Period,
 				bucket.DatetimeOptions.Location,
 			)
@@ -241,33 +621,49 @@ func (p *queryProcessor) fillBucketDatetimeGaps(bucket *Bucket, results map[stri
 
 	// Now recurse into any children result sets.
 	for _, result := range results {
-		result.bucketLookup = p.fillBucketDatetimeGaps(bucket.Bucket, result.bucketLookup)
+		result.bucketLookup = p.fillBucketDatetimeGaps(bucket.Bucket, query, result.bucketLookup)
+		for name, aggregation := range bucket.Aggregations {
+			if aggregationResult, ok := result.Aggregations[name]; ok {
+				p.fillDatetimeGaps(aggregation, aggregationResult)
+			}
+		}
 	}
 
 	return results
 }
 
-func (p *queryProcessor) sort(results map[string]*ResultBucket) []*ResultBucket {
-	return sortMap(p.query.Bucket, results)
+func (p *queryProcessor) sort() {
+	if p.err != nil || p.cancelled("sorting") {
+		return
+	}
+	sortResultset(p.ctx, p.query, p.results)
+
+	// Sorting stops early if the context is done, leaving the results unsorted.
+	p.cancelled("sorting")
 }
 
-func (p *queryProcessor) fillRangeGaps(results map[string]*ResultBucket) map[string]*ResultBucket {
-	if !p.hasRange {
-		return results
+func (p *queryProcessor) fillRangeGaps(query *Query, results *Resultset) {
+	if !p.hasRange || p.err != nil {
+		return
+	}
+	results.bucketLookup = p.fillBucketRangeGaps(query.Bucket, results.bucketLookup)
+	for name, aggregation := range query.Aggregations {
+		if result, ok := results.Aggregations[name]; ok {
+			p.fillRangeGaps(aggregation, result)
+		}
 	}
-	return p.fillBucketRangeGaps(p.query.Bucket, results)
 }
 
 func (p *queryProcessor) fillBucketRangeGaps(bucket *Bucket, results map[string]*ResultBucket) map[string]*ResultBucket {
-	if bucket == nil || len(results) < 0 {
+	if bucket == nil || p.err != nil {
 		return results
 	}
 
-	if (bucket.Field.Type == fieldTypeNumber) && (bucket.RangeOptions.Period != nil) {
-		for _, p := range bucket.RangeOptions.Period {
+	if bucket.Field != nil && (elementType(bucket.Field.Type) == fieldTypeNumber) && bucket.RangeOptions != nil && (bucket.RangeOptions.Period != nil) {
+		for _, period := range bucket.RangeOptions.Period {
 
 			var v float64
-			switch i := p.(type) {
+			switch i := period.(type) {
 			case float64:
 				v = i
 			case float32:
@@ -282,13 +678,21 @@ func (p *queryProcessor) fillBucketRangeGaps(bucket *Bucket, results map[string]
 
 			// Make sure this period exists.
 			index := decimal.NewFromFloat(v)
-			results[index.String()] = ensureValueBucket(results, index.String())
+			if !p.addBucket(bucket, results, index.String()) {
+				return results
+			}
+			results[index.String()] = ensureBucket(bucket, results, index)
 		}
 	}
 
 	// Now recurse into any children result sets.
 	for _, result := range results {
 		result.bucketLookup = p.fillBucketRangeGaps(bucket.Bucket, result.bucketLookup)
+		for name, aggregation := range bucket.Aggregations {
+			if aggregationResult, ok := result.Aggregations[name]; ok {
+				p.fillRangeGaps(aggregation, aggregationResult)
+			}
+		}
 	}
 
 	return results
@@ -299,34 +703,251 @@ func (p *queryProcessor) measure() {
 		return
 	}
 
+	scripts := p.parseScripts()
+	if p.err != nil {
+		return
+	}
+
 	// We only add metrics for the tip buckets, i.e. the deepest nesting.
-	for bucket := range p.tipBuckets {
-		// Create measurers for each of the metrics, then feed data into them.
-		bucket.Metrics = map[string]interface{}{}
-		var m measurer
-
-		for i := range p.query.Metrics {
-			metric := &p.query.Metrics[i]
-			// Create a measurer.
-			m, p.err = metric.measurer()
-			if p.err != nil {
-				return
+	if p.dataset.Workers > 1 {
+		p.measureParallel(p.dataset.Workers, scripts)
+		return
+	}
+	for bucket, query := range p.tipBuckets {
+		if p.cancelled("measuring") {
+			return
+		}
+		p.err = p.measureBucket(bucket, query, scripts[query])
+		if p.err != nil {
+			return
+		}
+	}
+}
+
+// parseScripts parses the bucket scripts of each query with tip buckets once,
+// rather than for every bucket.
+func (p *queryProcessor) parseScripts() map[*Query][]expression {
+	scripts := map[*Query][]expression{}
+	for _, query := range p.tipBuckets {
+		if _, ok := scripts[query]; ok {
+			continue
+		}
+		scripts[query], p.err = parseBucketScripts(query.Scripts)
+		if p.err != nil {
+			return nil
+		}
+	}
+	return scripts
+}
+
+// measureBucket runs each of the query's metrics and scripts against the rows
+// in the tip bucket.
+func (p *queryProcessor) measureBucket(bucket *ResultBucket, query *Query, scripts []expression) error {
+	// Create measurers for each of the metrics, then feed data into them.
+	measurers, err := newMeasurers(query.Metrics)
+	if err != nil {
+		return err
+	}
+	err = p.addMeasurerRows(query.Metrics, measurers, bucket.sourceRows)
+	if err != nil {
+		return err
+	}
+	return setBucketMetrics(bucket, query, measurers, scripts)
+}
+
+// newMeasurers creates a measurer for each of the metrics.
+func newMeasurers(metrics []Metric) ([]measurer, error) {
+	measurers := make([]measurer, len(metrics))
+	for i := range metrics {
+		m, err := metrics[i].measurer()
+		if err != nil {
+			return nil, err
+		}
+		measurers[i] = m
+	}
+	return measurers, nil
+}
+
+// addMeasurerRows adds the data of each of the rows at the given indexes to the
+// measurer of each metric. Rows without a value for the metric's field are
+// skipped. It is safe to call from multiple goroutines.
+func (p *queryProcessor) addMeasurerRows(metrics []Metric, measurers []measurer, indexes []int) error {
+metrics:
+	for i := range metrics {
+		metric := &metrics[i]
+		m := measurers[i]
+		read := p.source.field(metric.Field)
+		checked := false
+		for _, index := range indexes {
+			value, _ := read(index)
+			if value == nil {
+				continue
 			}
-			// Now add all of the data to the measurer.
-			for j := range bucket.sourceRows {
-				row := bucket.sourceRows[j]
-
-				// Check the field is of a metricable type.
-				if !row[metric.Field].IsMetricable(m) {
-					p.err = fmt.Errorf("Non metricable cell found (`%s:%s`)", metric.Field, metric.Type)
-					return
+
+			// Check the field is of a metricable type. A field only holds one
+			// type of value, so the first value is enough, and a lenient query
+			// skips the metric altogether, reporting it once for every row.
+			if !checked {
+				check := value
+				if elements, ok := value.([]interface{}); ok {
+					// An empty array has no element to check the type of.
+					if len(elements) == 0 {
+						continue
+					}
+					check = elements[0]
+				}
+				if cell := valueCell(check); cell == nil || !cell.IsMetricable(m) {
+					err := fmt.Errorf("Non metricable cell found (`%s:%s`)", metric.Field, metric.Type)
+					if p.rowErrors == nil {
+						return err
+					}
+					p.rowErrors.addMetric(metric.Field, metric.Field+MetricDelimeter+metric.Type, err.Error())
+					continue metrics
 				}
+				checked = true
+			}
 
-				m.AddDatum(row[metric.Field].MeasurableCell().Value())
+			// Metrics run on every element of an array.
+			if elements, ok := value.([]interface{}); ok {
+				for _, element := range elements {
+					m.AddDatum(element)
+				}
+				continue
 			}
+			m.AddDatum(value)
+		}
+	}
+	return nil
+}
 
-			// And then push the result into the metric resultset.
-			bucket.Metrics[metric.Field+MetricDelimeter+metric.Type] = m.Result()
+// valueCell returns an empty cell of the type that holds the value.
+func valueCell(value interface{}) Cell {
+	switch value.(type) {
+	case string:
+		return &StringCell{}
+	case *decimal.Decimal:
+		return &NumberCell{}
+	case *time.Time:
+		return &DatetimeCell{}
+	case bool:
+		return &BooleanCell{}
+	}
+	return nil
+}
+
+// setBucketMetrics pushes the result of each measurer into the bucket's
+// metrics, then computes any metrics derived from them with scripts.
+func setBucketMetrics(bucket *ResultBucket, query *Query, measurers []measurer, scripts []expression) error {
+	bucket.Metrics = map[string]interface{}{}
+	for i, metric := range query.Metrics {
+		bucket.Metrics[metric.Field+MetricDelimeter+metric.Type] = measurers[i].Result()
+	}
+	return runBucketScripts(query.Scripts, scripts, bucket)
+}
+
+// selectBuckets removes any result buckets that don't satisfy their bucket's
+// selectors, along with any parents left without children as a result.
+func (p *queryProcessor) selectBuckets() {
+	if p.err != nil || p.cancelled("selecting") {
+		return
+	}
+	p.err = selectResultset(p.query, p.results)
+}
+
+func selectResultset(query *Query, results *Resultset) error {
+	if err := selectBuckets(query.Bucket, results.bucketLookup); err != nil {
+		return err
+	}
+	return selectAggregations(query.Aggregations, results.Aggregations)
+}
+
+func selectAggregations(aggregations map[string]*Query, results map[string]*Resultset) error {
+	for name, query := range aggregations {
+		if result, ok := results[name]; ok {
+			if err := selectResultset(query, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func selectBuckets(bucket *Bucket, results map[string]*ResultBucket) error {
+	if bucket == nil {
+		return nil
+	}
+	for value, result := range results {
+		// Select the children first, removing this bucket if none remain.
+		hadChildren := len(result.bucketLookup) > 0
+		if err := selectBuckets(bucket.Bucket, result.bucketLookup); err != nil {
+			return err
+		}
+		if err := selectAggregations(bucket.Aggregations, result.Aggregations); err != nil {
+			return err
+		}
+		if hadChildren && len(result.bucketLookup) == 0 {
+			delete(results, value)
+			continue
+		}
+
+		for i := range bucket.Selectors {
+			ok, err := bucket.Selectors[i].Match(result)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				delete(results, value)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// pipeline runs any pipeline metrics across the measured and sorted results.
+func (p *queryProcessor) pipeline() {
+	if p.err != nil || p.cancelled("running pipelines") {
+		return
+	}
+	p.err = pipelineResultset(p.query, p.results)
+}
+
+func pipelineResultset(query *Query, results *Resultset) error {
+	if err := pipelineBuckets(query.Bucket, results.Buckets); err != nil {
+		return err
+	}
+	return pipelineAggregations(query.Aggregations, results.Aggregations)
+}
+
+func pipelineAggregations(aggregations map[string]*Query, results map[string]*Resultset) error {
+	for name, query := range aggregations {
+		if result, ok := results[name]; ok {
+			if err := pipelineResultset(query, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pipelineBuckets runs the bucket's pipelines across the sibling results, after
+// first running those of any nested buckets.
+func pipelineBuckets(bucket *Bucket, results []*ResultBucket) error {
+	if bucket == nil {
+		return nil
+	}
+	for _, result := range results {
+		if err := pipelineBuckets(bucket.Bucket, result.Buckets); err != nil {
+			return err
+		}
+		if err := pipelineAggregations(bucket.Aggregations, result.Aggregations); err != nil {
+			return err
+		}
+	}
+	for i := range bucket.Pipelines {
+		if err := bucket.Pipelines[i].apply(results); err != nil {
+			return err
 		}
 	}
+	return nil
 }
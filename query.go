@@ -6,20 +6,39 @@ import "time"
 type Query struct {
 	Bucket  *Bucket
 	Metrics []Metric
+	// Scripts compute additional metrics from the measured Metrics, in order.
+	Scripts []BucketScript
+	// Aggregations are named sibling queries, each run against the same rows
+	// as this query, with their own buckets and metrics.
+	Aggregations map[string]*Query
 }
 
 // Bucket defines how to compare and group data which is then aggregated on.
 type Bucket struct {
 	Bucket          *Bucket
+	Aggregations    map[string]*Query
 	Field           *Field
 	DatetimeOptions *DatetimeBucketOptions
 	Sort            *SortOptions
 	RangeOptions    *RangeBucketOptions
+	FilterOptions   *FilterBucketOptions
+	FiltersOptions  *FiltersBucketOptions
+	BooleanOptions  *BooleanBucketOptions
+	// Selectors remove result buckets that don't satisfy every condition. They
+	// are tested once metrics have been measured, and before sorting.
+	Selectors []BucketSelector
+	// Pipelines are run across this bucket's sorted result buckets once
+	// their metrics have been measured. Only the innermost bucket is measured,
+	// so pipelines on any other bucket are rejected. Buckets without a Sort are
+	// put in key order for their pipelines.
+	Pipelines []PipelineMetric
 }
 
 // SortOptions represent how this Bucket should be sorted.
 type SortOptions struct {
-	Type   string
+	// Type is one of alphabetical, numerical or metric.
+	Type string
+	// Metric is the key of the metric to sort by when Type is metric.
 	Metric string
 	Desc   bool
 }
@@ -40,3 +59,40 @@ type DatetimeBucketOptions struct {
 type RangeBucketOptions struct {
 	Period []interface{}
 }
+
+// BooleanBucketOptions provides additional configuration for boolean bucketing.
+// Rows are placed into a bucket with the value true or false.
+type BooleanBucketOptions struct {
+	// TrueLabel and FalseLabel are the labels of the true and false buckets,
+	// e.g. Active and Inactive. They default to the bucket values.
+	TrueLabel  string
+	FalseLabel string
+	// Missing places rows without a value into a bucket of their own, with a
+	// nil Key and labelled missing, rather than leaving them out.
+	Missing bool
+	// MissingLabel is the label of the missing bucket.
+	MissingLabel string
+}
+
+// The bucket holding rows without a value has a nil Key and an empty Value, so
+// that it can't be confused with the bucket of a real value, and is labelled
+// missing unless given a MissingLabel. missingBucketKey is the string form of
+// its key that it's looked up by, which begins with a NUL byte so that it
+// doesn't clash with the text of real values.
+const (
+	missingBucketKey   = "\x00missing"
+	missingBucketLabel = "missing"
+)
+
+// FilterBucketOptions narrows the rows under a bucket to those matching Filter.
+// Matching rows are placed into a single bucket with the given Value.
+type FilterBucketOptions struct {
+	Value  string
+	Filter *Filter
+}
+
+// FiltersBucketOptions creates a bucket for each of the named Filters. A row is
+// placed into the bucket of every filter that it matches.
+type FiltersBucketOptions struct {
+	Filters map[string]*Filter
+}
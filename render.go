@@ -0,0 +1,315 @@
+package aggro
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+// RenderOptions control how results are rendered as text.
+type RenderOptions struct {
+	// Style is the style of table rendered by RenderTable, one of ascii,
+	// unicode or markdown. Defaults to ascii.
+	Style string
+	// Metrics are the keys of the metrics to render, e.g. salary:mean. Defaults
+	// to every metric found, in alphabetical order.
+	Metrics []string
+	// NumberFormat is a fmt verb that numbers are formatted with, e.g. %.2f.
+	// Defaults to their shortest exact representation.
+	NumberFormat string
+	// NumberFormats override NumberFormat for particular metrics, by key.
+	NumberFormats map[string]string
+	// Thousands groups the digits of numbers in thousands with commas.
+	Thousands bool
+	// MaxWidth is the maximum number of characters shown for a value. Longer
+	// values are truncated with an ellipsis. Zero is unlimited.
+	MaxWidth int
+}
+
+// tableBorders are the characters a table is drawn with: the horizontal line,
+// vertical line, and the corners and junctions of the top, middle and bottom.
+type tableBorders struct {
+	horizontal, vertical string
+	top, middle, bottom  [3]string
+}
+
+var (
+	asciiBorders = &tableBorders{
+		horizontal: "-", vertical: "|",
+		top:    [3]string{"+", "+", "+"},
+		middle: [3]string{"+", "+", "+"},
+		bottom: [3]string{"+", "+", "+"},
+	}
+	unicodeBorders = &tableBorders{
+		horizontal: "─", vertical: "│",
+		top:    [3]string{"┌", "┬", "┐"},
+		middle: [3]string{"├", "┼", "┤"},
+		bottom: [3]string{"└", "┴", "┘"},
+	}
+)
+
+// RenderTable writes the table to w as text. The row titles form the leading
+// columns, followed by a column for each metric of each column title. Column
+// headers join the column title and metric with slashes. Numbers are aligned
+// to the right.
+func RenderTable(w io.Writer, table *ResultTable, options *RenderOptions) error {
+	if options == nil {
+		options = &RenderOptions{}
+	}
+	metrics := options.Metrics
+	if len(metrics) == 0 {
+		cells := []map[string]interface{}{}
+		for _, row := range table.Rows {
+			cells = append(cells, row...)
+		}
+		metrics = metricKeys(cells)
+	}
+	rowDepth := titleDepth(table.RowTitles)
+
+	// Build every line of text first, so that the columns can be sized.
+	header := make([]string, rowDepth)
+	for _, column := range table.ColumnTitles {
+		for _, metric := range metrics {
+			header = append(header, options.cellText(strings.Join(append(column[:len(column):len(column)], metric), " / ")))
+		}
+	}
+	lines := [][]string{}
+	numeric := make([]bool, len(header))
+	for i, row := range table.Rows {
+		line := make([]string, rowDepth, len(header))
+		for j, title := range table.RowTitles[i] {
+			line[j] = options.cellText(title)
+		}
+		for _, cell := range row {
+			for _, metric := range metrics {
+				text, isNumber := options.format(metric, cell[metric])
+				if isNumber {
+					numeric[len(line)] = true
+				}
+				line = append(line, options.cellText(text))
+			}
+		}
+		lines = append(lines, line)
+	}
+	widths := make([]int, len(header))
+	for _, line := range append([][]string{header}, lines...) {
+		for j, text := range line {
+			if width := utf8.RuneCountInString(text); width > widths[j] {
+				widths[j] = width
+			}
+		}
+	}
+
+	var out strings.Builder
+	switch options.Style {
+	case "", "ascii", "unicode":
+		borders := asciiBorders
+		if options.Style == "unicode" {
+			borders = unicodeBorders
+		}
+		out.WriteString(borders.rule(borders.top, widths))
+		out.WriteString(borders.line(header, widths, nil))
+		out.WriteString(borders.rule(borders.middle, widths))
+		for _, line := range lines {
+			out.WriteString(borders.line(line, widths, numeric))
+		}
+		out.WriteString(borders.rule(borders.bottom, widths))
+	case "markdown":
+		for j := range widths {
+			// The alignment row needs at least three dashes.
+			if widths[j] < 3 {
+				widths[j] = 3
+			}
+		}
+		out.WriteString(markdownLine(header, widths, nil))
+		alignment := make([]string, len(widths))
+		for j, width := range widths {
+			if numeric[j] {
+				alignment[j] = strings.Repeat("-", width-1) + ":"
+			} else {
+				alignment[j] = strings.Repeat("-", width)
+			}
+		}
+		out.WriteString("| " + strings.Join(alignment, " | ") + " |\n")
+		for _, line := range lines {
+			out.WriteString(markdownLine(line, widths, numeric))
+		}
+	default:
+		return fmt.Errorf("Unknown render style: %s", options.Style)
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// rule draws a horizontal line across columns of the given widths.
+func (borders *tableBorders) rule(corners [3]string, widths []int) string {
+	parts := make([]string, len(widths))
+	for j, width := range widths {
+		parts[j] = strings.Repeat(borders.horizontal, width+2)
+	}
+	return corners[0] + strings.Join(parts, corners[1]) + corners[2] + "\n"
+}
+
+// line draws a line of text, padding each column to its width.
+func (borders *tableBorders) line(texts []string, widths []int, numeric []bool) string {
+	parts := make([]string, len(texts))
+	for j, text := range texts {
+		parts[j] = " " + pad(text, widths[j], numeric != nil && numeric[j]) + " "
+	}
+	return borders.vertical + strings.Join(parts, borders.vertical) + borders.vertical + "\n"
+}
+
+// markdownLine draws a line of a Markdown table, whose texts are escaped.
+func markdownLine(texts []string, widths []int, numeric []bool) string {
+	parts := make([]string, len(texts))
+	for j, text := range texts {
+		parts[j] = pad(text, widths[j], numeric != nil && numeric[j])
+	}
+	return "| " + strings.Join(parts, " | ") + " |\n"
+}
+
+// pad pads the text with spaces to the width, on the left if right is set.
+func pad(text string, width int, right bool) string {
+	padding := width - utf8.RuneCountInString(text)
+	if padding <= 0 {
+		return text
+	}
+	if right {
+		return strings.Repeat(" ", padding) + text
+	}
+	return text + strings.Repeat(" ", padding)
+}
+
+// RenderTree writes the results to w as an indented tree, with a line for each
+// bucket showing its value and metrics. Sibling aggregations follow the
+// buckets they sit beside, under their name in square brackets.
+func RenderTree(w io.Writer, results *Resultset, options *RenderOptions) error {
+	if options == nil {
+		options = &RenderOptions{}
+	}
+	var out strings.Builder
+	options.renderResultset(&out, 0, results)
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func (options *RenderOptions) renderResultset(out *strings.Builder, depth int, results *Resultset) {
+	options.renderBuckets(out, depth, results.Buckets)
+	options.renderAggregations(out, depth, results.Aggregations)
+}
+
+func (options *RenderOptions) renderAggregations(out *strings.Builder, depth int, aggregations map[string]*Resultset) {
+	names := make([]string, 0, len(aggregations))
+	for name := range aggregations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out.WriteString(strings.Repeat("  ", depth) + "[" + options.truncate(name) + "]\n")
+		options.renderResultset(out, depth+1, aggregations[name])
+	}
+}
+
+func (options *RenderOptions) renderBuckets(out *strings.Builder, depth int, buckets []*ResultBucket) {
+	for _, bucket := range buckets {
+		out.WriteString(strings.Repeat("  ", depth) + options.truncate(bucket.label()))
+		metrics := options.Metrics
+		if len(metrics) == 0 {
+			metrics = metricKeys([]map[string]interface{}{bucket.Metrics})
+		}
+		for _, metric := range metrics {
+			if _, ok := bucket.Metrics[metric]; !ok {
+				continue
+			}
+			text, _ := options.format(metric, bucket.Metrics[metric])
+			out.WriteString("  " + metric + "=" + options.truncate(text))
+		}
+		out.WriteString("\n")
+		options.renderBuckets(out, depth+1, bucket.Buckets)
+		options.renderAggregations(out, depth+1, bucket.Aggregations)
+	}
+}
+
+// format formats a metric value as text, reporting whether it is a number.
+func (options *RenderOptions) format(metric string, value interface{}) (string, bool) {
+	verb := options.NumberFormat
+	if format, ok := options.NumberFormats[metric]; ok {
+		verb = format
+	}
+
+	var text string
+	switch v := value.(type) {
+	case float64, float32, int, int64, decimal.Decimal, *decimal.Decimal:
+		f, ok := metricFloat(v)
+		if !ok {
+			return "", false
+		}
+		if verb != "" {
+			text = fmt.Sprintf(verb, f)
+		} else {
+			text = formatCSVValue(v)
+		}
+	default:
+		return formatCSVValue(value), false
+	}
+	if options.Thousands {
+		text = groupThousands(text)
+	}
+	return text, true
+}
+
+// groupThousands separates the digits before the decimal point of a formatted
+// number into groups of three with commas.
+func groupThousands(text string) string {
+	start := 0
+	if start < len(text) && (text[start] == '-' || text[start] == '+') {
+		start++
+	}
+	end := start
+	for end < len(text) && text[end] >= '0' && text[end] <= '9' {
+		end++
+	}
+	digits := text[start:end]
+	if len(digits) <= 3 {
+		return text
+	}
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return text[:start] + grouped.String() + text[end:]
+}
+
+// truncate shortens text to MaxWidth characters, ending it with an ellipsis.
+func (options *RenderOptions) truncate(text string) string {
+	if options.MaxWidth <= 0 || utf8.RuneCountInString(text) <= options.MaxWidth {
+		return text
+	}
+	ellipsis := "…"
+	if options.Style == "" || options.Style == "ascii" {
+		ellipsis = "..."
+	}
+	// If there's no room for any text, even the ellipsis is cut short.
+	keep := options.MaxWidth - utf8.RuneCountInString(ellipsis)
+	if keep <= 0 {
+		return string([]rune(ellipsis)[:options.MaxWidth])
+	}
+	return string([]rune(text)[:keep]) + ellipsis
+}
+
+// cellText truncates the text of a table cell, then in Markdown escapes any
+// pipes, so that the columns are sized to the text as written.
+func (options *RenderOptions) cellText(text string) string {
+	text = options.truncate(text)
+	if options.Style == "markdown" {
+		text = strings.Replace(text, "|", `\|`, -1)
+	}
+	return text
+}
@@ -0,0 +1,111 @@
+package aggro
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRenderTable(t *testing.T) {
+	RegisterTestingT(t)
+	_, results := departmentResults(t, []Metric{{Type: "max", Field: "salary"}, {Type: "count", Field: "salary"}}, nil)
+	table, err := Tabulate(results, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error converting results: %s", err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	err = RenderTable(buf, table, &RenderOptions{Metrics: []string{"salary:max"}})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering table: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`+------------+--------------------------+------------------------+
+|            | Engineering / salary:max | Marketing / salary:max |
++------------+--------------------------+------------------------+
+| Auckland   |                   120000 |                 150000 |
+| Wellington |                   160000 |                        |
++------------+--------------------------+------------------------+
+`))
+
+	buf.Reset()
+	err = RenderTable(buf, table, &RenderOptions{
+		Style:         "unicode",
+		Metrics:       []string{"salary:max", "salary:count"},
+		NumberFormat:  "%.2f",
+		NumberFormats: map[string]string{"salary:count": "%.0f"},
+		Thousands:     true,
+		MaxWidth:      12,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering table: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`┌────────────┬──────────────┬──────────────┬──────────────┬──────────────┐
+│            │ Engineering… │ Engineering… │ Marketing /… │ Marketing /… │
+├────────────┼──────────────┼──────────────┼──────────────┼──────────────┤
+│ Auckland   │   120,000.00 │            2 │   150,000.00 │            2 │
+│ Wellington │   160,000.00 │            3 │              │              │
+└────────────┴──────────────┴──────────────┴──────────────┴──────────────┘
+`))
+
+	buf.Reset()
+	err = RenderTable(buf, table, &RenderOptions{Style: "markdown", Metrics: []string{"salary:count"}})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering table: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`|            | Engineering / salary:count | Marketing / salary:count |
+| ---------- | -------------------------: | -----------------------: |
+| Auckland   |                          2 |                        2 |
+| Wellington |                          3 |                          |
+`))
+
+	err = RenderTable(buf, table, &RenderOptions{Style: "html"})
+	Expect(err).To(MatchError("Unknown render style: html"))
+
+	// Pipes are escaped before the columns are sized, and values never exceed
+	// MaxWidth, even when it is narrower than the ellipsis.
+	piped := &ResultTable{
+		RowTitles:    [][]string{{"a|b"}, {"Wel"}},
+		ColumnTitles: [][]string{{"x"}},
+		Rows:         [][]map[string]interface{}{{{"n": 1.0}}, {{"n": 2.0}}},
+	}
+	buf.Reset()
+	err = RenderTable(buf, piped, &RenderOptions{Style: "markdown"})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering table: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`|      | x / n |
+| ---- | ----: |
+| a\|b |     1 |
+| Wel  |     2 |
+`))
+	buf.Reset()
+	err = RenderTable(buf, piped, &RenderOptions{MaxWidth: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering table: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`+----+----+
+|    | .. |
++----+----+
+| .. |  1 |
+| .. |  2 |
++----+----+
+`))
+}
+
+func TestRenderTree(t *testing.T) {
+	RegisterTestingT(t)
+	_, results := departmentResults(t, []Metric{{Type: "max", Field: "salary"}, {Type: "count", Field: "salary"}}, nil)
+
+	buf := &bytes.Buffer{}
+	err := RenderTree(buf, results, &RenderOptions{Thousands: true, MaxWidth: 8})
+	if err != nil {
+		t.Fatalf("Unexpected error rendering tree: %s", err.Error())
+	}
+	Expect(buf.String()).To(Equal(`Auckland
+  Engin...  salary:count=2  salary:max=120,000
+  Marke...  salary:count=2  salary:max=150,000
+Welli...
+  Engin...  salary:count=3  salary:max=160,000
+`))
+}
@@ -2,23 +2,96 @@ package aggro
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
 // Resultset represents a complete set of result buckets and any associated errors.
 type Resultset struct {
-	Errors      []error         `json:"errors"`
-	Buckets     []*ResultBucket `json:"buckets"`
-	Composition []interface{}   `json:"-"`
+	Errors       []error               `json:"errors"`
+	Buckets      []*ResultBucket       `json:"buckets"`
+	Aggregations map[string]*Resultset `json:"aggregations,omitempty"`
+	Composition  []interface{}         `json:"-"`
+	bucketLookup map[string]*ResultBucket
+	// query and source are the query that produced the results, and the rows
+	// it read, so that Tabulate can measure margins.
+	query  *Query
+	source rowSource
 }
 
 // ResultBucket represents recursively built metrics for our tablular data.
 type ResultBucket struct {
-	Value        string                 `json:"value"`
+	// Key is the typed value of the bucket: a time.Time for datetime buckets,
+	// a decimal.Decimal for number buckets, a bool for boolean buckets and a
+	// string otherwise.
+	Key interface{} `json:"-"`
+	// Value is the string form of Key, which buckets are looked up by.
+	// Datetimes are RFC3339 strings and numbers are exact decimal strings. The
+	// missing bucket of a boolean bucket has a nil Key and an empty Value.
+	Value string `json:"value"`
+	// Label is the text the bucket is displayed with. Buckets without a label
+	// are displayed with their Value.
+	Label        string                 `json:"-"`
 	Metrics      map[string]interface{} `json:"metrics"`
 	Buckets      []*ResultBucket        `json:"buckets"`
+	Aggregations map[string]*Resultset  `json:"aggregations,omitempty"`
 	bucketLookup map[string]*ResultBucket
-	sourceRows   []map[string]Cell
+	sourceRows   []int
+	rowCount     int
+}
+
+// label returns the bucket's Label, or its Value if it has no label.
+func (bucket *ResultBucket) label() string {
+	if bucket.Label == "" {
+		return bucket.Value
+	}
+	return bucket.Label
+}
+
+// lookupValue returns the value the bucket is looked up by, which for the
+// missing bucket is missingBucketKey rather than its empty Value.
+func (bucket *ResultBucket) lookupValue() string {
+	if bucket.Key == nil && bucket.Value == "" {
+		return missingBucketKey
+	}
+	return bucket.Value
+}
+
+// cloneResultset copies the result tree so that it can be pruned, sorted and
+// have pipelines run on it without modifying the original. Rows are shared.
+func cloneResultset(results *Resultset) *Resultset {
+	clone := *results
+	clone.bucketLookup = cloneBuckets(results.bucketLookup)
+	clone.Aggregations = cloneAggregations(results.Aggregations)
+	return &clone
+}
+
+func cloneAggregations(aggregations map[string]*Resultset) map[string]*Resultset {
+	if aggregations == nil {
+		return nil
+	}
+	clone := make(map[string]*Resultset, len(aggregations))
+	for name, results := range aggregations {
+		clone[name] = cloneResultset(results)
+	}
+	return clone
+}
+
+func cloneBuckets(buckets map[string]*ResultBucket) map[string]*ResultBucket {
+	clone := make(map[string]*ResultBucket, len(buckets))
+	for value, bucket := range buckets {
+		b := *bucket
+		if bucket.Metrics != nil {
+			b.Metrics = make(map[string]interface{}, len(bucket.Metrics))
+			for key, metric := range bucket.Metrics {
+				b.Metrics[key] = metric
+			}
+		}
+		b.bucketLookup = cloneBuckets(bucket.bucketLookup)
+		b.Aggregations = cloneAggregations(bucket.Aggregations)
+		clone[value] = &b
+	}
+	return clone
 }
 
 // ResultTable represents a Resultset split into row / columns at a depth.
@@ -26,19 +99,47 @@ type ResultTable struct {
 	Rows         [][]map[string]interface{} `json:"rows"`
 	RowTitles    [][]string                 `json:"row_titles"`
 	ColumnTitles [][]string                 `json:"column_titles"`
+	// Margins is set when the last row and column are totals.
+	Margins bool `json:"margins,omitempty"`
 }
 
 // Concrete errors.
 var (
 	ErrTargetDepthTooLow     = fmt.Errorf("Tabulate: target depth should be 1 or above")
 	ErrTargetDepthNotReached = fmt.Errorf("Tabulate: reached deepest bucket before hitting target depth")
+	ErrMarginsWithoutRows    = fmt.Errorf("Tabulate: margins require results from running a query on a dataset")
 )
 
+// MarginTitle is the title of the total row and column added by margins.
+var MarginTitle = "Total"
+
+// TabulateOptions control how a Resultset is converted to tabular data.
+type TabulateOptions struct {
+	// Margins appends a total column to each row, and a total row with a total
+	// for each column and a grand total. Totals are measured from the rows in
+	// the tip buckets of the row or column, so metrics such as mean and median
+	// are correct rather than summed from the cells. Rows in more than one tip
+	// bucket, such as with filters buckets, are only measured once.
+	Margins bool
+}
+
 // Tabulate takes a Resultset and converts it to tabular data.
 func Tabulate(results *Resultset, depth int) (*ResultTable, error) {
+	return TabulateWithOptions(results, depth, nil)
+}
+
+// TabulateWithOptions takes a Resultset and converts it to tabular data, as
+// configured by the options.
+func TabulateWithOptions(results *Resultset, depth int, options *TabulateOptions) (*ResultTable, error) {
 	if depth < 1 {
 		return nil, ErrTargetDepthTooLow
 	}
+	if options == nil {
+		options = &TabulateOptions{}
+	}
+	if options.Margins && (results.query == nil || results.source == nil) {
+		return nil, ErrMarginsWithoutRows
+	}
 	// Create our table.
 	table := &ResultTable{
 		Rows:         [][]map[string]interface{}{},
@@ -49,26 +150,33 @@ func Tabulate(results *Resultset, depth int) (*ResultTable, error) {
 	// And a lookup helper instance.
 	lookup := &resultLookup{
 		cells:        map[string]map[string]interface{}{},
+		tips:         map[string]*ResultBucket{},
 		rowLookup:    map[string]bool{},
 		columnLookup: map[string]bool{},
 	}
 
 	// Recursively build the lookup for each of the root result buckets.
 	for _, bucket := range results.Buckets {
-		err := buildLookup([]string{}, 1, depth, table, lookup, bucket)
+		err := buildLookup([]string{}, []string{}, 1, depth, table, lookup, bucket)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// Now build up the cells for each of the row / column tuples.
-	for _, row := range table.RowTitles {
+	for _, row := range lookup.rowKeys {
 		tableRow := []map[string]interface{}{}
-		for _, column := range table.ColumnTitles {
-			tableRow = append(tableRow, lookup.cells[strings.Join(row, lookupKeyDelimiter)+lookupKeyDelimiter+strings.Join(column, lookupKeyDelimiter)])
+		for _, column := range lookup.columnKeys {
+			tableRow = append(tableRow, lookup.cells[row+lookupKeyDelimiter+column])
 		}
 		table.Rows = append(table.Rows, tableRow)
 	}
+	if options.Margins {
+		err := addMargins(results, table, lookup)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// And we're done 👌.
 	return table, nil
 }
@@ -76,18 +184,122 @@ func Tabulate(results *Resultset, depth int) (*ResultTable, error) {
 // resultLookup stores specific data as the result set is recursively iterated over.
 type resultLookup struct {
 	cells        map[string]map[string]interface{}
+	tips         map[string]*ResultBucket
 	rowLookup    map[string]bool
 	columnLookup map[string]bool
+	// rowKeys and columnKeys are the keys of the table's rows and columns, in
+	// the same order as their titles. Keys are made of bucket values, as
+	// different buckets may share a label.
+	rowKeys    []string
+	columnKeys []string
+}
+
+// addMargins appends a total cell to each row of the table, and a total row.
+func addMargins(results *Resultset, table *ResultTable, lookup *resultLookup) error {
+	scripts, err := parseBucketScripts(results.query.Scripts)
+	if err != nil {
+		return err
+	}
+	rowKeys := lookup.rowKeys
+	columnKeys := lookup.columnKeys
+	tip := func(row, column int) *ResultBucket {
+		return lookup.tips[rowKeys[row]+lookupKeyDelimiter+columnKeys[column]]
+	}
+
+	// Total each row across the columns.
+	for i := range table.Rows {
+		tips := []*ResultBucket{}
+		for j := range columnKeys {
+			tips = append(tips, tip(i, j))
+		}
+		total, err := measureMargin(results, scripts, tips)
+		if err != nil {
+			return err
+		}
+		table.Rows[i] = append(table.Rows[i], total)
+	}
+
+	// Then each column down the rows, and finally everything.
+	totals := []map[string]interface{}{}
+	all := []*ResultBucket{}
+	for j := range columnKeys {
+		tips := []*ResultBucket{}
+		for i := range rowKeys {
+			tips = append(tips, tip(i, j))
+		}
+		total, err := measureMargin(results, scripts, tips)
+		if err != nil {
+			return err
+		}
+		totals = append(totals, total)
+		all = append(all, tips...)
+	}
+	total, err := measureMargin(results, scripts, all)
+	if err != nil {
+		return err
+	}
+	table.Rows = append(table.Rows, append(totals, total))
+	table.RowTitles = append(table.RowTitles, marginTitle(titleDepth(table.RowTitles)))
+	table.ColumnTitles = append(table.ColumnTitles, marginTitle(titleDepth(table.ColumnTitles)))
+	table.Margins = true
+	return nil
+}
+
+// marginTitle returns the title of a margin with the given number of levels.
+func marginTitle(depth int) []string {
+	title := make([]string, depth)
+	if depth > 0 {
+		title[0] = MarginTitle
+	}
+	return title
+}
+
+// measureMargin measures the query's metrics and scripts across the rows of
+// each of the tip buckets, which may be nil. Cells that can't be measured are
+// skipped, as the query has already either reported or failed on them.
+func measureMargin(results *Resultset, scripts []expression, tips []*ResultBucket) (map[string]interface{}, error) {
+	seen := map[int]bool{}
+	indexes := []int{}
+	for _, tip := range tips {
+		if tip == nil {
+			continue
+		}
+		for _, index := range tip.sourceRows {
+			if !seen[index] {
+				seen[index] = true
+				indexes = append(indexes, index)
+			}
+		}
+	}
+	sort.Ints(indexes)
+
+	p := &queryProcessor{
+		source:    results.source,
+		rowErrors: newRowErrors(&LenientOptions{}),
+	}
+	measurers, err := newMeasurers(results.query.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	err = p.addMeasurerRows(results.query.Metrics, measurers, indexes)
+	if err != nil {
+		return nil, err
+	}
+	margin := &ResultBucket{rowCount: len(indexes)}
+	err = setBucketMetrics(margin, results.query, measurers, scripts)
+	return margin.Metrics, err
 }
 
 // lookupKeyDelimiter is used to flatten a string array to a single key.
 const lookupKeyDelimiter = "😡"
 
 // buildLookup is a recursive function that breaks data into rows and columns
-// at a specific depth.
-func buildLookup(key []string, depth, targetDepth int, table *ResultTable, lookup *resultLookup, bucket *ResultBucket) error {
-	// Add the new bucket value to the lookup key.
-	key = append(key, bucket.Value)
+// at a specific depth. Rows and columns are keyed by their buckets' values, and
+// titled with their labels.
+func buildLookup(key, title []string, depth, targetDepth int, table *ResultTable, lookup *resultLookup, bucket *ResultBucket) error {
+	// Add the new bucket value to the lookup key, and its label to the title.
+	key = append(key, bucket.lookupValue())
+	title = append(title, bucket.label())
 
 	// If we have no buckets, we're at a metric point.
 	if len(bucket.Buckets) == 0 {
@@ -98,11 +310,13 @@ func buildLookup(key []string, depth, targetDepth int, table *ResultTable, looku
 		columnKey := strings.Join(key[targetDepth:], lookupKeyDelimiter)
 		// If we haven't seen this column tuple before, add it to the lookup.
 		if _, ok := lookup.columnLookup[columnKey]; !ok {
-			table.ColumnTitles = append(table.ColumnTitles, key[targetDepth:])
+			table.ColumnTitles = append(table.ColumnTitles, title[targetDepth:])
+			lookup.columnKeys = append(lookup.columnKeys, columnKey)
 			lookup.columnLookup[columnKey] = true
 		}
 		m := bucket.Metrics
 		lookup.cells[strings.Join(key, lookupKeyDelimiter)] = m
+		lookup.tips[strings.Join(key, lookupKeyDelimiter)] = bucket
 		return nil
 	}
 
@@ -110,7 +324,8 @@ func buildLookup(key []string, depth, targetDepth int, table *ResultTable, looku
 	if depth == targetDepth {
 		rowKey := strings.Join(key, lookupKeyDelimiter)
 		if _, ok := lookup.rowLookup[rowKey]; !ok {
-			table.RowTitles = append(table.RowTitles, key)
+			table.RowTitles = append(table.RowTitles, title)
+			lookup.rowKeys = append(lookup.rowKeys, rowKey)
 			lookup.rowLookup[rowKey] = true
 		}
 	}
@@ -119,7 +334,9 @@ func buildLookup(key []string, depth, targetDepth int, table *ResultTable, looku
 	for _, bucket := range bucket.Buckets {
 		newKey := make([]string, len(key))
 		copy(newKey, key)
-		err := buildLookup(newKey, depth+1, targetDepth, table, lookup, bucket)
+		newTitle := make([]string, len(title))
+		copy(newTitle, title)
+		err := buildLookup(newKey, newTitle, depth+1, targetDepth, table, lookup, bucket)
 		if err != nil {
 			return err
 		}
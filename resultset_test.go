@@ -366,3 +366,62 @@ func TestTabulateDepthTooHigh(t *testing.T) {
 		t.Fatalf("Expected error converting results, got none")
 	}
 }
+
+func TestTabulateMargins(t *testing.T) {
+	RegisterTestingT(t)
+	dataset := &Dataset{Table: table}
+	err := dataset.AddRows(rows...)
+	if err != nil {
+		t.Fatalf("Unexpected error creating dataset: %s", err.Error())
+	}
+	results, err := dataset.Run(&Query{
+		Metrics: []Metric{
+			{Type: "mean", Field: "salary"},
+			{Type: "median", Field: "salary"},
+			{Type: "count", Field: "salary"},
+		},
+		Bucket: &Bucket{
+			Field: &Field{Name: "location", Type: "string"},
+			Sort:  &SortOptions{Type: "alphabetical"},
+			Bucket: &Bucket{
+				Field: &Field{Name: "department", Type: "string"},
+				Sort:  &SortOptions{Type: "alphabetical"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error running query: %s", err.Error())
+	}
+
+	table, err := TabulateWithOptions(results, 1, &TabulateOptions{Margins: true})
+	if err != nil {
+		t.Fatalf("Unexpected error converting results: %s", err.Error())
+	}
+	rm, _ := json.Marshal(*table)
+	Expect(rm).To(MatchJSON(`{
+		"row_titles": [["Auckland"], ["Wellington"], ["Total"]],
+		"column_titles": [["Engineering"], ["Marketing"], ["Total"]],
+		"margins": true,
+		"rows": [
+			[
+				{"salary:mean": 100000, "salary:median": 100000, "salary:count": 2},
+				{"salary:mean": 120000, "salary:median": 120000, "salary:count": 2},
+				{"salary:mean": 110000, "salary:median": 105000, "salary:count": 4}
+			],
+			[
+				{"salary:mean": 133333.33333333334, "salary:median": 120000, "salary:count": 3},
+				null,
+				{"salary:mean": 133333.33333333334, "salary:median": 120000, "salary:count": 3}
+			],
+			[
+				{"salary:mean": 120000, "salary:median": 120000, "salary:count": 5},
+				{"salary:mean": 120000, "salary:median": 120000, "salary:count": 2},
+				{"salary:mean": 120000, "salary:median": 120000, "salary:count": 7}
+			]
+		]
+	}`))
+
+	// Margins can't be measured without the rows behind the results.
+	_, err = TabulateWithOptions(&Resultset{}, 1, &TabulateOptions{Margins: true})
+	Expect(err).To(Equal(ErrMarginsWithoutRows))
+}
@@ -0,0 +1,386 @@
+package aggro
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// snapshotMagic starts every dataset snapshot.
+const snapshotMagic = "AGGRO"
+
+// snapshotVersion is the version of the snapshot format written by WriteTo.
+// ReadDataset rejects snapshots of any other version.
+const snapshotVersion = 1
+
+// Flags stored in a snapshot's header.
+const (
+	snapshotColumnar = 1 << iota
+)
+
+// ErrSnapshotChecksum is returned by ReadDataset when a snapshot's contents
+// don't match its checksum.
+var ErrSnapshotChecksum = errors.New("Dataset snapshot checksum mismatch")
+
+// WriteTo writes the dataset's Table and every cell, including those of derived
+// fields, to w in a binary snapshot format that can be loaded with ReadDataset.
+// Numbers keep their exact decimal values. The snapshot ends with a CRC-32
+// checksum of its contents. Workers, Limits and live queries aren't included,
+// nor is the data each row was added from.
+func (set *Dataset) WriteTo(w io.Writer) (int64, error) {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.write([]byte(snapshotMagic))
+	sw.writeUvarint(snapshotVersion)
+	flags := uint64(0)
+	if set.Columns != nil {
+		flags |= snapshotColumnar
+	}
+	sw.writeUvarint(flags)
+
+	// Write the schema, followed by the rows.
+	fields := snapshotFields(set.Table)
+	sw.writeUvarint(uint64(len(set.Table.Fields)))
+	for _, field := range set.Table.Fields {
+		sw.writeString(field.Name)
+		sw.writeString(field.Type)
+	}
+	sw.writeUvarint(uint64(len(set.Table.Derived)))
+	for _, derived := range set.Table.Derived {
+		sw.writeString(derived.Name)
+		sw.writeString(derived.Type)
+		sw.writeString(derived.Expression)
+	}
+	source := set.source()
+	readers := make([]fieldReader, len(fields))
+	for i, field := range fields {
+		readers[i] = source.field(field.Name)
+	}
+	sw.writeUvarint(uint64(source.length()))
+	for index := 0; index < source.length() && sw.err == nil; index++ {
+		for i, field := range fields {
+			value, _ := readers[i](index)
+			sw.writeValue(field, value)
+		}
+	}
+
+	// The checksum covers everything before it.
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, sw.crc)
+	sw.write(checksum)
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	return sw.n, sw.err
+}
+
+// ReadDataset loads a dataset from a snapshot written by Dataset.WriteTo. The
+// dataset stores its rows in Columns if the snapshotted dataset did. As the
+// input is buffered, r may be read past the end of the snapshot.
+func ReadDataset(r io.Reader) (*Dataset, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	if magic := sr.readN(len(snapshotMagic)); sr.err == nil && string(magic) != snapshotMagic {
+		return nil, errors.New("Invalid dataset snapshot: missing header")
+	}
+	if version := sr.readUvarint(); sr.err == nil && version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported dataset snapshot version %d", version)
+	}
+	flags := sr.readUvarint()
+
+	// Counts may be corrupt, so slices grow as items are read rather than being
+	// allocated up front.
+	table := &Table{}
+	count := sr.readCount()
+	for i := 0; i < count && sr.err == nil; i++ {
+		table.Fields = append(table.Fields, Field{Name: sr.readString(), Type: sr.readString()})
+	}
+	count = sr.readCount()
+	for i := 0; i < count && sr.err == nil; i++ {
+		table.Derived = append(table.Derived, DerivedField{
+			Field:      Field{Name: sr.readString(), Type: sr.readString()},
+			Expression: sr.readString(),
+		})
+	}
+	if sr.err != nil {
+		return nil, sr.snapshotError()
+	}
+
+	set := &Dataset{Table: table}
+	if flags&snapshotColumnar != 0 {
+		set.Columns = &Columns{}
+	}
+	fields := snapshotFields(table)
+	values := make([]interface{}, len(fields))
+	count = sr.readCount()
+	for i := 0; i < count && sr.err == nil; i++ {
+		for j, field := range fields {
+			values[j] = sr.readValue(field)
+		}
+		if sr.err != nil {
+			break
+		}
+
+		// Columns take the values as they are, saving building cells.
+		if set.Columns != nil {
+			set.Columns.appendValues(table, values)
+			continue
+		}
+		row := make(map[string]Cell, len(fields))
+		for j, field := range fields {
+			if values[j] == nil {
+				continue
+			}
+			row[field.Name], sr.err = newCell(nil, values[j], field)
+			if sr.err != nil {
+				break
+			}
+		}
+		set.store(row)
+	}
+	if sr.err != nil {
+		return nil, sr.snapshotError()
+	}
+
+	// Check the contents against the checksum, which isn't part of them.
+	expected := sr.crc
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(sr.r, checksum); err != nil {
+		sr.err = err
+		return nil, sr.snapshotError()
+	}
+	if binary.BigEndian.Uint32(checksum) != expected {
+		return nil, ErrSnapshotChecksum
+	}
+	return set, nil
+}
+
+// snapshotFields returns the stored and derived fields of the table, in the
+// order their cells are written.
+func snapshotFields(table *Table) []*Field {
+	fields := make([]*Field, 0, len(table.Fields)+len(table.Derived))
+	for i := range table.Fields {
+		fields = append(fields, &table.Fields[i])
+	}
+	for i := range table.Derived {
+		fields = append(fields, &table.Derived[i].Field)
+	}
+	return fields
+}
+
+// snapshotWriter writes the parts of a snapshot, keeping a running checksum and
+// count of the bytes written. Once a write fails, later writes do nothing.
+type snapshotWriter struct {
+	w       *bufio.Writer
+	crc     uint32
+	n       int64
+	err     error
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	var n int
+	n, sw.err = sw.w.Write(p)
+	sw.n += int64(n)
+	sw.crc = crc32.Update(sw.crc, crc32.IEEETable, p[:n])
+}
+
+func (sw *snapshotWriter) writeByte(b byte) {
+	sw.scratch[0] = b
+	sw.write(sw.scratch[:1])
+}
+
+func (sw *snapshotWriter) writeUvarint(value uint64) {
+	sw.write(sw.scratch[:binary.PutUvarint(sw.scratch[:], value)])
+}
+
+func (sw *snapshotWriter) writeBytes(p []byte) {
+	sw.writeUvarint(uint64(len(p)))
+	sw.write(p)
+}
+
+func (sw *snapshotWriter) writeString(value string) {
+	sw.writeBytes([]byte(value))
+}
+
+// writeValue writes a cell value of the field's type, preceded by whether the
+// cell has a value.
+func (sw *snapshotWriter) writeValue(field *Field, value interface{}) {
+	if value == nil {
+		sw.writeByte(0)
+		return
+	}
+	sw.writeByte(1)
+
+	// Arrays are a count of elements, followed by each element's value.
+	if isArrayType(field.Type) {
+		elements := value.([]interface{})
+		element := elementField(field)
+		sw.writeUvarint(uint64(len(elements)))
+		for _, value := range elements {
+			sw.writeValue(element, value)
+		}
+		return
+	}
+
+	var data []byte
+	var err error
+	switch field.Type {
+	case fieldTypeString:
+		sw.writeString(value.(string))
+		return
+	case fieldTypeBoolean:
+		if value.(bool) {
+			sw.writeByte(1)
+		} else {
+			sw.writeByte(0)
+		}
+		return
+	case fieldTypeNumber:
+		data, err = value.(*decimal.Decimal).MarshalBinary()
+	case fieldTypeDatetime:
+		data, err = value.(*time.Time).MarshalBinary()
+	default:
+		err = fmt.Errorf("Unknown field type: %s", field.Type)
+	}
+	if err != nil {
+		if sw.err == nil {
+			sw.err = fmt.Errorf("Error writing field %s: %s", field.Name, err.Error())
+		}
+		return
+	}
+	sw.writeBytes(data)
+}
+
+// snapshotReader reads the parts of a snapshot, keeping a running checksum of
+// the bytes read. Once a read fails, later reads return zero values.
+type snapshotReader struct {
+	r       *bufio.Reader
+	crc     uint32
+	err     error
+	scratch [1]byte
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.scratch[0] = b
+		sr.crc = crc32.Update(sr.crc, crc32.IEEETable, sr.scratch[:])
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) readByte() byte {
+	if sr.err != nil {
+		return 0
+	}
+	var b byte
+	b, sr.err = sr.ReadByte()
+	return b
+}
+
+func (sr *snapshotReader) readUvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	var value uint64
+	value, sr.err = binary.ReadUvarint(sr)
+	return value
+}
+
+// readCount reads a number of items, or a length in bytes.
+func (sr *snapshotReader) readCount() int {
+	count := sr.readUvarint()
+	if count > math.MaxInt32 {
+		sr.err = fmt.Errorf("count %d is too large", count)
+		return 0
+	}
+	return int(count)
+}
+
+// readN reads n bytes. Large reads are buffered as the bytes arrive, so that a
+// corrupt length doesn't allocate more than the snapshot holds.
+func (sr *snapshotReader) readN(n int) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	var p []byte
+	if n <= 1<<16 {
+		p = make([]byte, n)
+		_, sr.err = io.ReadFull(sr.r, p)
+	} else {
+		buf := &bytes.Buffer{}
+		_, sr.err = io.CopyN(buf, sr.r, int64(n))
+		p = buf.Bytes()
+	}
+	if sr.err != nil {
+		return nil
+	}
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, p)
+	return p
+}
+
+func (sr *snapshotReader) readBytes() []byte {
+	return sr.readN(sr.readCount())
+}
+
+func (sr *snapshotReader) readString() string {
+	return string(sr.readBytes())
+}
+
+// readValue reads a value of the field's type, of the same type as its cell's
+// Value. It is nil if the row had no value for the field.
+func (sr *snapshotReader) readValue(field *Field) interface{} {
+	if sr.readByte() == 0 {
+		return nil
+	}
+
+	if isArrayType(field.Type) {
+		// The count may be corrupt, so the slice grows as elements are read.
+		elements := []interface{}{}
+		element := elementField(field)
+		count := sr.readCount()
+		for i := 0; i < count && sr.err == nil; i++ {
+			elements = append(elements, sr.readValue(element))
+		}
+		return elements
+	}
+
+	switch field.Type {
+	case fieldTypeString:
+		return sr.readString()
+	case fieldTypeBoolean:
+		return sr.readByte() != 0
+	case fieldTypeNumber:
+		d := &decimal.Decimal{}
+		if data := sr.readBytes(); sr.err == nil {
+			sr.err = d.UnmarshalBinary(data)
+		}
+		return d
+	case fieldTypeDatetime:
+		t := &time.Time{}
+		if data := sr.readBytes(); sr.err == nil {
+			sr.err = t.UnmarshalBinary(data)
+		}
+		return t
+	}
+	sr.err = fmt.Errorf("Unknown field type: %s", field.Type)
+	return nil
+}
+
+// snapshotError describes the error that stopped a snapshot being read.
+func (sr *snapshotReader) snapshotError() error {
+	if sr.err == io.EOF || sr.err == io.ErrUnexpectedEOF {
+		return errors.New("Invalid dataset snapshot: unexpected end of data")
+	}
+	return fmt.Errorf("Invalid dataset snapshot: %s", sr.err.Error())
+}
@@ -1,8 +1,8 @@
 package aggro
 
 import (
+	"context"
 	"sort"
-	"strconv"
 )
 
 // Sortable provides an interface that various sorters can implement to compare
@@ -27,6 +27,11 @@ func sortableForOptions(options *SortOptions) Sortable {
 	case "numerical":
 		s := NumericalSortable(!options.Desc)
 		return &s
+	case "metric":
+		return &MetricSortable{
+			Metric: options.Metric,
+			Asc:    !options.Desc,
+		}
 	}
 	return nil
 }
@@ -44,12 +49,27 @@ func (sortable *AlphabeticalSortable) Less(a, b *ResultBucket) bool {
 // direction of the boolean, true meaning ascending and false being descending.
 type NumericalSortable bool
 
-// Less implements Sortable by comparing the value field of each result.
+// Less implements Sortable by comparing the typed key of each result, so that
+// numbers compare numerically and datetimes chronologically.
 func (sortable *NumericalSortable) Less(a, b *ResultBucket) bool {
-	// Cast bucket.Value (str) to float for comparison.
-	a1, _ := strconv.ParseFloat(a.Value, 64)
-	b1, _ := strconv.ParseFloat(b.Value, 64)
-	return a1 < b1 == bool(*sortable)
+	return compareKeys(a.Key, b.Key) < 0 == bool(*sortable)
+}
+
+// MetricSortable sorts by the value of a metric in the direction of Asc.
+// Results without a numerical value for the metric are always sorted last.
+type MetricSortable struct {
+	Metric string
+	Asc    bool
+}
+
+// Less implements Sortable by comparing the metric of each result.
+func (sortable *MetricSortable) Less(a, b *ResultBucket) bool {
+	a1, aOk := metricFloat(a.Metrics[sortable.Metric])
+	b1, bOk := metricFloat(b.Metrics[sortable.Metric])
+	if !aOk || !bOk {
+		return aOk && !bOk
+	}
+	return a1 < b1 == sortable.Asc
 }
 
 // bucketSorter is an implementation of the sort.Sort interface that is capable
@@ -76,27 +96,76 @@ func (sorter *bucketSorter) Less(i, j int) bool {
 }
 
 // sortMap takes a map of results and returns it as a sorted slice.
-func sortMap(bucket *Bucket, results map[string]*ResultBucket) []*ResultBucket {
+func sortMap(ctx context.Context, bucket *Bucket, results map[string]*ResultBucket) []*ResultBucket {
 	resultSlice := []*ResultBucket{}
 	for _, result := range results {
 		resultSlice = append(resultSlice, result)
 	}
-	return sortSlice(bucket, resultSlice)
+	return sortSlice(ctx, bucket, resultSlice)
 }
 
 // sortSlice takes a slice of results and sorts it via a bucketSorter instance.
-func sortSlice(bucket *Bucket, results []*ResultBucket) []*ResultBucket {
+// If the context is done, the results are returned without being sorted.
+func sortSlice(ctx context.Context, bucket *Bucket, results []*ResultBucket) []*ResultBucket {
+	if ctx.Err() != nil {
+		return results
+	}
 	sorter := &bucketSorter{
 		results:  results,
 		sortable: sortableForOptions(bucket.Sort),
 	}
+	// Pipelines run across the buckets in order, so buckets without a sort
+	// of their own are put in key order rather than left in map order.
+	if sorter.sortable == nil && len(bucket.Pipelines) > 0 {
+		byKey := NumericalSortable(true)
+		sorter.sortable = &byKey
+	}
 	if sorter.sortable != nil {
 		sort.Sort(sorter)
 	}
+	// The bucket of rows without a value isn't one of the values being sorted,
+	// so always comes last.
+	if options := bucket.BooleanOptions; options != nil && options.Missing {
+		sorter.results = missingLast(sorter.results)
+	}
 	for _, result := range sorter.results {
 		if bucket.Bucket != nil {
-			result.Buckets = sortMap(bucket.Bucket, result.bucketLookup)
+			result.Buckets = sortMap(ctx, bucket.Bucket, result.bucketLookup)
 		}
+		sortAggregations(ctx, bucket.Aggregations, result.Aggregations)
 	}
 	return sorter.results
 }
+
+// missingLast moves the missing bucket of a boolean bucket's results, if there
+// is one, to the end.
+func missingLast(results []*ResultBucket) []*ResultBucket {
+	for i, result := range results {
+		if result.Key == nil {
+			missing := result
+			copy(results[i:], results[i+1:])
+			results[len(results)-1] = missing
+			break
+		}
+	}
+	return results
+}
+
+// sortResultset sorts the root buckets of a resultset, and those of any of its
+// sibling aggregations.
+func sortResultset(ctx context.Context, query *Query, results *Resultset) {
+	if query.Bucket != nil {
+		results.Buckets = sortMap(ctx, query.Bucket, results.bucketLookup)
+	}
+	sortAggregations(ctx, query.Aggregations, results.Aggregations)
+}
+
+// sortAggregations sorts each of the named aggregation results with the
+// matching aggregation query.
+func sortAggregations(ctx context.Context, aggregations map[string]*Query, results map[string]*Resultset) {
+	for name, query := range aggregations {
+		if result, ok := results[name]; ok {
+			sortResultset(ctx, query, result)
+		}
+	}
+}
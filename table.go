@@ -1,5 +1,99 @@
 package aggro
 
+import (
+	"fmt"
+)
+
+// Table represents the Fields that make up each row of a Dataset.
 type Table struct {
 	Fields []Field
+	// Derived fields are computed from each row's other cells as it is added.
+	Derived []DerivedField
+}
+
+// DerivedField is a Field whose value is computed from an expression over the
+// row's other cells rather than read from the row data, e.g. `salary + bonus`.
+// Fields are referred to by name, and derived fields may refer to any derived
+// field defined before them. The expression's result must be a valid value for
+// the field's Type. See expression.go for the expression syntax.
+//
+// Derived values are computed once, as each row is added, so an expression
+// using now() records the time the row was added rather than the time it is
+// queried.
+type DerivedField struct {
+	Field
+	Expression string
+}
+
+// expressions parses the expression of each derived field.
+func (table *Table) expressions() ([]expression, error) {
+	expressions := make([]expression, len(table.Derived))
+	for i, derived := range table.Derived {
+		expr, err := parseExpression(derived.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expression for field %s: %s", derived.Name, err.Error())
+		}
+		// Derived fields are computed in order, so later ones aren't available.
+		for _, name := range expressionIdentifiers(expr) {
+			for _, later := range table.Derived[i:] {
+				if later.Name == name {
+					return nil, fmt.Errorf("Invalid expression for field %s: Field %s is derived after it", derived.Name, name)
+				}
+			}
+		}
+		expressions[i] = expr
+	}
+	return expressions, nil
+}
+
+// rowScope resolves identifiers in a derived field expression to the values of
+// the row's cells.
+func (table *Table) rowScope(row map[string]Cell) expressionScope {
+	return func(name string) (interface{}, error) {
+		cell, ok := row[name]
+		if !ok {
+			// The field may exist, but have no value for this row.
+			if table.field(name) != nil {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Unknown field %s", name)
+		}
+		return cellExpressionValue(cell), nil
+	}
+}
+
+// field returns the stored or derived field with the given name, if any.
+func (table *Table) field(name string) *Field {
+	for i := range table.Fields {
+		if table.Fields[i].Name == name {
+			return &table.Fields[i]
+		}
+	}
+	for i := range table.Derived {
+		if table.Derived[i].Name == name {
+			return &table.Derived[i].Field
+		}
+	}
+	return nil
+}
+
+// cellExpressionValue converts a cell to its expression value.
+func cellExpressionValue(cell Cell) interface{} {
+	switch tCell := cell.(type) {
+	case *NumberCell:
+		return *tCell.value
+	case *StringCell:
+		return tCell.value
+	case *DatetimeCell:
+		return *tCell.value
+	case *BooleanCell:
+		return tCell.value
+	case *ArrayCell:
+		values := make([]interface{}, len(tCell.elements))
+		for i, element := range tCell.elements {
+			values[i] = cellExpressionValue(element)
+		}
+		return values
+	}
+	return nil
 }